@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	Shared by the logger and the node, see the Makefile
+		key=value options of a message
+		vector clocks	[name:count,...]
+		acks of a buffer of pending events, of a node or a relay
+*/
+
+// parseOptions returns the key=value tokens of a message
+func parseOptions(fields []string) map[string]string {
+	opts := make(map[string]string)
+	for _, f := range fields {
+		if i := strings.IndexByte(f, '='); i > 0 {
+			opts[f[:i]] = f[i+1:]
+		}
+	}
+	return opts
+}
+
+func formatVClock(vc map[string]int64) string {
+	var names []string
+	for name := range vc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var s []string
+	for _, name := range names {
+		s = append(s, name+":"+strconv.FormatInt(vc[name], 10))
+	}
+	return strings.Join(s, ",")
+}
+
+// ackPending drops the pending event seq and returns the remaining events
+// and how many of them were sent. Acks come in the order events were sent,
+// so it is usually the first one; pending is searched in seq order unless
+// unsorted is set
+func ackPending[T any](pending []T, sent int, seqOf func(T) int64, unsorted bool, seq int64) ([]T, int) {
+	var i int
+	if unsorted {
+		for i < len(pending) && seqOf(pending[i]) != seq {
+			i++
+		}
+	} else {
+		i = sort.Search(len(pending), func(i int) bool { return seqOf(pending[i]) >= seq })
+	}
+	if i == len(pending) || seqOf(pending[i]) != seq {
+		return pending, sent
+	}
+	if i == 0 {
+		pending = pending[1:]
+	} else {
+		pending = append(pending[:i], pending[i+1:]...)
+	}
+	if i < sent {
+		sent--
+	}
+	return pending, sent
+}
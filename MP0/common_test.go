@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAckPending(t *testing.T) {
+	tests := []struct {
+		name     string
+		pending  []int64
+		sent     int
+		unsorted bool
+		acks     []int64
+		wantLeft []int64
+		wantSent int
+	}{
+		{"in order", []int64{1, 2, 3, 4}, 3, false, []int64{1, 2}, []int64{3, 4}, 1},
+		{"middle", []int64{1, 2, 3, 4}, 4, false, []int64{3}, []int64{1, 2, 4}, 3},
+		{"unsent", []int64{1, 2, 3}, 1, false, []int64{3}, []int64{1, 2}, 1},
+		{"duplicate", []int64{2, 3}, 2, false, []int64{1, 2, 2}, []int64{3}, 1},
+		{"unknown", []int64{5, 7}, 2, false, []int64{6, 8}, []int64{5, 7}, 2},
+		{"all", []int64{1, 2}, 2, false, []int64{1, 2}, []int64{}, 0},
+		{"out of order", []int64{1, 4, 2, 3}, 4, true, []int64{2, 4}, []int64{1, 3}, 2},
+	}
+	seqOf := func(seq int64) int64 { return seq }
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			left, sent := append([]int64{}, tt.pending...), tt.sent
+			for _, seq := range tt.acks {
+				left, sent = ackPending(left, sent, seqOf, tt.unsorted, seq)
+			}
+			if fmt.Sprint(left) != fmt.Sprint(tt.wantLeft) || sent != tt.wantSent {
+				t.Errorf("left %v sent %d, want %v sent %d", left, sent, tt.wantLeft, tt.wantSent)
+			}
+		})
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	got := parseOptions([]string{"100.0", "node1", "ev", "seq=3", "vc=a:1,b:2", "=x", "off="})
+	want := map[string]string{"seq": "3", "vc": "a:1,b:2", "off": ""}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("parseOptions = %v, want %v", got, want)
+	}
+}
+
+func TestFormatVClock(t *testing.T) {
+	if got := formatVClock(map[string]int64{"b": 2, "a": 1}); got != "a:1,b:2" {
+		t.Errorf("formatVClock = %q, want %q", got, "a:1,b:2")
+	}
+}
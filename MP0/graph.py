@@ -1,3 +1,4 @@
+import json
 import numpy as np
 import matplotlib.pyplot as plt
 
@@ -7,6 +8,8 @@ import matplotlib.pyplot as plt
         of 8 nodes 5 hz to "8.txt"
     Change the variable profileNum to 3 or 8 to choose the
     log file to process
+
+    Both the text log and the json log (./logger -format json) are accepted
 '''
 
 profileNum = 8
@@ -18,21 +21,41 @@ nodeList = []
 dat = {}
 npDat=np.zeros((0, 3))
 
-while True:
-    logLine = f.readline()
-    if logLine == "" or logLine == "\n" or logLine is None:
-        break    
-    log = logLine.split(' ')
-    delay = float(f.readline())
-    bandwidth = int(f.readline())
-    if(len(log) == 4): #connection
-        nodeList.append(log[2])
-        dat[log[2]] = {"delay": [], "bandwidth": []}
-    else: #event
-        dat[log[1]]['delay'].append(delay)
-        dat[log[1]]['bandwidth'].append(bandwidth)
-    time = float(log[0])
-    npDat = np.append(npDat, [[time, delay, bandwidth]], axis = 0)
+def readText(f):
+    while True:
+        logLine = f.readline()
+        if logLine == "" or logLine == "\n" or logLine is None:
+            break
+        log = logLine.split()
+        delay = float(f.readline().split()[-1]) # corrected delay if logged
+        bandwidth = int(f.readline().split()[0]) # bytes of the event, not of the wire
+        if(len(log) == 4 and log[1] == '-'): #connected, rejected
+            yield {'type': log[3], 'node': log[2], 'client_ts': float(log[0]),
+                   'delay': delay, 'bytes': bandwidth}
+        else: #event
+            yield {'type': 'event', 'node': log[1], 'client_ts': float(log[0]),
+                   'delay': delay, 'bytes': bandwidth}
+
+def readJSON(f):
+    for logLine in f:
+        if logLine.strip() != "":
+            rec = json.loads(logLine)
+            rec['delay'] = rec.get('corrected_delay', rec['delay'])
+            yield rec
+
+first = f.read(1)
+f.seek(0)
+for rec in (readJSON(f) if first == '{' else readText(f)):
+    if rec['type'] == 'connected':
+        if rec['node'] not in dat: # reconnects keep the data so far
+            nodeList.append(rec['node'])
+            dat[rec['node']] = {"delay": [], "bandwidth": []}
+    elif rec['type'] == 'event':
+        dat[rec['node']]['delay'].append(rec['delay'])
+        dat[rec['node']]['bandwidth'].append(rec['bytes'])
+    else:
+        continue
+    npDat = np.append(npDat, [[rec['client_ts'], rec['delay'], rec['bytes']]], axis = 0)
 
 npDat[:,0] = npDat[:,0] - np.min(npDat[:,0])
 n = npDat.shape[0]
@@ -2,80 +2,509 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+/*
+	Log formats (selected with -format)
+		text: three lines per event, kept for graph.py
+			[raw message]
+			[delay] [corrected delay]
+			[length] [wire length]
+		json: one Record per line
+			{"type":"event","node":"node1","client_ts":...,"server_ts":...,
+			 "delay":...,"offset":...,"corrected_delay":...,"bytes":...,"wire_bytes":...,
+			 "conn_id":...,"seq":...,"lamport":...,"vclock":{...},
+			 "msg":"..."}
+	the text log keeps events as "[timestamp] [node name] [event]" and drops
+	the key=value options of the wire format (see logger_seq.go)
+	delay is server_ts - client_ts, corrected_delay removes the node clock
+	offset estimated by the sync exchange (see logger_sync.go); for events
+	forwarded by a relay it is end to end, and hop_delay is the delay of the
+	last hop (see logger_relay.go)
+*/
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+// Record : one self-describing log entry
+type Record struct {
+	Type      string           `json:"type"`
+	Node      string           `json:"node"`
+	ClientTS  float64          `json:"client_ts"`
+	ServerTS  float64          `json:"server_ts"`
+	Delay     float64          `json:"delay"`
+	Offset    float64          `json:"offset"`
+	CorDelay  float64          `json:"corrected_delay"`
+	HopDelay  float64          `json:"hop_delay,omitempty"`
+	Relay     string           `json:"relay,omitempty"`
+	Bytes     int              `json:"bytes"`
+	WireBytes int              `json:"wire_bytes"`
+	ConnID    int64            `json:"conn_id"`
+	Seq       int64            `json:"seq,omitempty"`
+	Lamport   int64            `json:"lamport,omitempty"`
+	VClock    map[string]int64 `json:"vclock,omitempty"`
+	Msg       string           `json:"msg,omitempty"`
+
+	seqLine string // for the seq file, see logger_seq.go
+}
+
+// nodeConn : state of one node connection (or UDP sender)
+type nodeConn struct {
+	id       int64
+	name     string
+	conn     io.Writer
+	writeMtx sync.Mutex
+	done     chan struct{}
+	identity string // certificate name, "" without client certificates
+	relay    bool   // a relay forwarding events, see logger_relay.go
+	replica  bool   // a peer replicating its events, see logger_relay.go
+
+	syncMtx sync.Mutex
+	samples []syncSample
+	offset  float64
+}
+
 var path = "log.txt"
-var m sync.Mutex
 
-func handleConn(conn net.Conn, file *(os.File), err_f error) {
+var logFormat string
+var file *rotatingFile
+
+var nextConnID int64
+
+// open connections, drained on shutdown
+var connsMtx sync.Mutex
+var openConns = make(map[net.Conn]bool)
+var connsWg sync.WaitGroup
+var shuttingDown bool
+var drainTimeout time.Duration
+
+func getTime() float64 {
+	return float64(time.Now().UnixNano()) / float64(time.Second)
+}
+
+// writeRecord queues one entry for the writer, which writes whole entries
+// so concurrent connections never interleave their lines; the returned
+// channel is closed once the entry is written
+func writeRecord(rec Record, raw string) <-chan struct{} {
+	done := make(chan struct{})
+	var out string
+	if logFormat == formatJSON {
+		b, err := json.Marshal(rec)
+		if isError(err) {
+			close(done)
+			return done
+		}
+		out = string(b) + "\n"
+	} else {
+		if rec.Type == "disconnected" {
+			close(done)
+			return done
+		}
+		out = raw + fmt.Sprintf("%f %f\n%d %d\n", rec.Delay, rec.CorDelay, rec.Bytes, rec.WireBytes)
+	}
+	writeQueue <- writeReq{out: out, seqLine: rec.seqLine, done: done}
+	return done
+}
+
+// logRecord writes a record and feeds it to the live stats, metrics,
+// subscribers and run summary; the returned channel is closed once the
+// record is written
+func logRecord(rec Record, raw string) <-chan struct{} {
+	written := writeRecord(rec, raw)
+	addStats(rec)
+	observe(rec)
+	publish(rec)
+	summarize(rec)
+	return written
+}
+
+// writeLine sends a control message to the node
+func (nc *nodeConn) writeLine(msg string) error {
+	nc.writeMtx.Lock()
+	defer nc.writeMtx.Unlock()
+	_, err := nc.conn.Write([]byte(msg))
+	return err
+}
+
+// newRecord parses a raw message "timestamp ..." received at serverTS
+func newRecord(recType string, nc *nodeConn, dat string, serverTS float64) (Record, error) {
+	fields := strings.Fields(dat)
+	if len(fields) < 2 {
+		return Record{}, fmt.Errorf("Logger: malformed message %q", dat)
+	}
+	clientTS, err := strconv.ParseFloat(fields[0], 64) // client time
+	if err != nil {
+		return Record{}, fmt.Errorf("Logger: bad timestamp in %q", dat)
+	}
+	offset := nc.getOffset()
+	rec := Record{
+		Type:      recType,
+		Node:      nc.name,
+		ClientTS:  clientTS,
+		ServerTS:  serverTS,
+		Delay:     serverTS - clientTS,
+		Offset:    offset,
+		CorDelay:  serverTS - (clientTS - offset),
+		Bytes:     len(dat),
+		WireBytes: len(dat),
+		ConnID:    nc.id,
+	}
+	opts := parseOptions(fields[3:])
+	if nc.relay {
+		if off, err := strconv.ParseFloat(opts["off"], 64); err == nil {
+			// relayed: off is the node clock offset to the relay
+			rec.Offset += off
+			rec.CorDelay = serverTS - (clientTS - rec.Offset)
+		}
+		if hop, err := strconv.ParseFloat(opts["hop"], 64); err == nil {
+			rec.HopDelay = serverTS - (hop - offset)
+		}
+		rec.Relay = opts["via"]
+	}
+	if recType == "event" && len(fields) >= 3 {
+		rec.Msg = fields[2]
+		rec.Seq = parseSeq(opts, "seq")
+		rec.Lamport = parseSeq(opts, "lc")
+		rec.VClock = parseVClock(opts["vc"])
+	}
+	return rec, nil
+}
+
+func handleConn(conn net.Conn, connID int64) {
+	defer func() {
+		conn.Close()
+		connsMtx.Lock()
+		delete(openConns, conn)
+		connsMtx.Unlock()
+		connsWg.Done()
+	}()
+	identity, err := authenticate(conn)
+	if err != nil {
+		reject(conn, connID, "", err.Error())
+		return
+	}
 	reader := bufio.NewReader(conn)
 	dat, err := reader.ReadString('\n')
-	_ = err
-	fmt.Fprintf(os.Stdout, dat)
-
-	nodeName := strings.Split(dat, " ")[2]
-	m.Lock()
-	file.WriteString(dat)
-	m.Unlock()
-	timestamp_c, err := strconv.ParseFloat(strings.Split(dat, " ")[0], 64) // client time
-	timestamp_s := float64(time.Now().UnixNano()) / float64(time.Second)
-	time_delay_str := fmt.Sprintf("%f", timestamp_s-timestamp_c) + "\n"
-	bandwidth_str := fmt.Sprintf("%d", len(dat)) + "\n"
-	// file.WriteString(dat)
-	file.WriteString(time_delay_str)
-	file.WriteString(bandwidth_str)
+	if err != nil {
+		return
+	}
+	timestampS := getTime()
+	fmt.Print(dat)
+
+	// first line: "timestamp - nodeName connected"
+	fields := strings.Fields(dat)
+	if len(fields) < 3 {
+		fmt.Fprintf(os.Stderr, "Logger: bad handshake %q\n", dat)
+		return
+	}
+	if !authorized(identity, fields[2]) {
+		reject(conn, connID, fields[2], fmt.Sprintf("authenticated as %q", identity))
+		return
+	}
+	nc := &nodeConn{id: connID, name: fields[2], conn: conn, done: make(chan struct{}), identity: identity}
+	defer close(nc.done)
+	handleHello(nc, dat, timestampS)
 
 	for {
-		dat, err := bufio.NewReader(conn).ReadString('\n')
+		dat, err := reader.ReadString('\n')
 		if err != nil {
-			timeString := fmt.Sprintf("%f", float64(time.Now().UnixNano())/float64(time.Second))
-			out := timeString + " - " + nodeName + " disconnected\n"
-			fmt.Fprintf(os.Stdout, out)
-			m.Lock()
-			m.Unlock()
+			timestampS := getTime()
+			out := fmt.Sprintf("%f", timestampS) + " - " + nc.name + " disconnected\n"
+			fmt.Print(out)
+			logRecord(Record{Type: "disconnected", Node: nc.name, ServerTS: timestampS, ConnID: nc.id}, out)
 			break
 		}
+		timestampS := getTime()
+		if strings.HasPrefix(dat, "SYNC ") {
+			isError(handleSyncReply(nc, dat, timestampS))
+			continue
+		}
+		if strings.HasPrefix(dat, "PING ") {
+			nc.writeLine("PONG " + dat[len("PING "):])
+			continue
+		}
+		if strings.HasPrefix(dat, "Z ") {
+			// a broken connection shows up on the next read
+			isError(handleFrame(nc, dat, reader, timestampS))
+			continue
+		}
+		fmt.Print(dat)
 
-		timestamp_c, err := strconv.ParseFloat(strings.Split(dat, " ")[0], 64) // client time
-		timestamp_s := float64(time.Now().UnixNano()) / float64(time.Second)
-		fmt.Fprintf(os.Stdout, dat)
+		_, _, err = handleEvent(nc, dat, timestampS, len(dat))
+		isError(err)
+	}
+}
 
-		m.Lock()
-		time_delay_str := fmt.Sprintf("%f", timestamp_s-timestamp_c) + "\n"
-		bandwidth_str := fmt.Sprintf("%d", len(dat)) + "\n"
-		file.WriteString(dat)
-		file.WriteString(time_delay_str)
-		file.WriteString(bandwidth_str)
-		m.Unlock()
+// handleHello registers a node from its "timestamp - nodeName connected"
+// line and starts syncing its clock
+func handleHello(nc *nodeConn, dat string, timestampS float64) {
+	fields := strings.Fields(dat)
+	go runSync(nc, syncInterval)
+	opts := parseOptions(fields[3:])
+	registerNode(nc.name, opts)
+	if opts["via"] != "" {
+		// off, hop and via shift delays, only relays may send them
+		nc.relay = mayRelay(nc)
+		if !nc.relay {
+			fmt.Fprintf(os.Stderr, "Logger: ignoring relay options of %s, not a trusted relay\n", nc.name)
+			delete(opts, "via")
+		}
+	}
+	if opts["replica"] == "1" {
+		// replicated events are not forwarded, only peers may send them
+		nc.replica = mayReplicate(nc)
+		if !nc.replica {
+			fmt.Fprintf(os.Stderr, "Logger: ignoring replica=1 of %s, not a peer\n", nc.name)
+		}
+	}
+	if !nc.replica {
+		forwardHello(nc.name, opts)
+	}
+	rec, err := newRecord("connected", nc, dat, timestampS)
+	if !isError(err) {
+		logRecord(rec, fmt.Sprintf("%s - %s connected\n", fields[0], nc.name))
 	}
 }
 
+// handleEvent logs one event of nc that took wireBytes on the wire and acks
+// it; it returns the record and whether it was logged, false for a duplicate
+// or a dropped event. A TCP node is only acked once the event is in the log
+// file, as it never replays an acked event; UDP senders never replay, so
+// the shared reader does not wait for the writer.
+func handleEvent(nc *nodeConn, dat string, timestampS float64, wireBytes int) (Record, bool, error) {
+	rec, err := newRecord("event", nc, dat, timestampS)
+	if err != nil {
+		return rec, false, err
+	}
+	_, udp := nc.conn.(*udpPeer)
+	// replays are acked without taking tokens, only new events are limited
+	if rec.Seq != 0 && isDuplicate(nc.name, rec.Seq) {
+		if !udp {
+			flushWrites() // the first copy may still be queued
+		}
+		nc.writeLine(fmt.Sprintf("ACK %d %s\n", rec.Seq, currentClocks()))
+		return rec, false, nil
+	}
+	if !admit(nc.name, !udp) {
+		return Record{}, false, nil
+	}
+	rec.WireBytes = wireBytes
+	if rec.Seq == 0 {
+		mergeClocks(rec)
+		logRecord(rec, dat)
+		if !nc.replica {
+			forward(rec, dat, !udp)
+		}
+		return rec, true, nil
+	}
+	var clocks string
+	isNew, seqLine := acceptSeq(nc.name, rec.Seq)
+	if isNew {
+		rec.seqLine = seqLine
+		clocks = mergeClocks(rec)
+		written := logRecord(rec, fmt.Sprintf("%s %s %s\n", strings.Fields(dat)[0], nc.name, rec.Msg))
+		if !nc.replica {
+			forward(rec, dat, !udp)
+		}
+		if !udp {
+			<-written
+		}
+	} else {
+		if !udp {
+			flushWrites()
+		}
+		clocks = currentClocks()
+	}
+	nc.writeLine(fmt.Sprintf("ACK %d %s\n", rec.Seq, clocks))
+	return rec, isNew, nil
+}
+
 func main() {
-	args := os.Args
-	port := ":" + args[1]
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		os.Exit(runReport(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		os.Exit(runQuery(os.Args[2:]))
+	}
+	flag.StringVar(&logFormat, "format", formatText, "log format: text or json")
+	flag.StringVar(&statsPath, "stats", "stats.txt", "per-second stats file, empty to disable")
+	flag.DurationVar(&syncInterval, "sync", 10*time.Second, "clock offset resync interval, 0 to sync on connect only")
+	flag.StringVar(&metricsAddr, "metrics", "", "address of the metrics HTTP listener, e.g. :9100, empty to disable")
+	flag.StringVar(&subscribePort, "subscribe", "", "port for live subscribers, empty to disable")
+	flag.Int64Var(&rotateSize, "rotate-size", 0, "rotate log files larger than this many bytes, 0 to disable")
+	flag.DurationVar(&rotateInterval, "rotate-interval", 0, "rotate log files older than this, 0 to disable")
+	flag.IntVar(&retainFiles, "retain", 0, "max number of rotated files kept per log, 0 keeps all")
+	flag.BoolVar(&gzipRotated, "gzip", false, "gzip rotated log files")
+	flag.StringVar(&summaryPath, "summary", "summary.txt", "file the run summary is appended to on exit, empty to only print it")
+	flag.DurationVar(&drainTimeout, "drain", 2*time.Second, "time open connections get to deliver pending events on shutdown")
+	flag.StringVar(&causalPath, "causal", "", "file the causally ordered events are written to on exit")
+	flag.StringVar(&concurrentPath, "concurrent", "", "file the concurrent event pairs are written to on exit")
+	flag.BoolVar(&udpEnabled, "udp", false, "also accept events as UDP datagrams on the same port")
+	flag.StringVar(&upstreamAddr, "upstream", "", "forward every logged event to the parent logger at host:port")
+	flag.StringVar(&peerAddrs, "peers", "", "comma separated host:port of peer loggers every node event is replicated to")
+	flag.StringVar(&relayHosts, "relays", "", "comma separated hosts of relays whose forwarded events keep their relay options, without TLS")
+	flag.StringVar(&relayName, "relay-name", "", "name of this logger in forwarded events (default hostname:port)")
+	flag.Float64Var(&rateLimit, "rate-limit", 0, "max events per second of each node, 0 for no limit")
+	flag.IntVar(&burst, "burst", 10, "events a node may send at once above -rate-limit")
+	flag.IntVar(&writeQueueSize, "write-queue", 10000, "max log entries waiting for the writer")
+	flag.StringVar(&tlsCertPath, "tls-cert", "", "certificate file, enables TLS")
+	flag.StringVar(&tlsKeyPath, "tls-key", "", "private key file of -tls-cert")
+	flag.StringVar(&tlsCAPath, "tls-ca", "", "CA file, required with -tls-cert, nodes must present a certificate for their name signed by it")
+	flag.StringVar(&trustList, "trust", "", "comma separated certificate names that may send events of any node (relays, peers)")
+	flag.Parse()
+	if flag.NArg() != 1 || (logFormat != formatText && logFormat != formatJSON) || burst < 1 || writeQueueSize < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: ./logger [-format text|json] [-stats file] [-sync interval] [-metrics addr] [-subscribe port]\n\t[-rotate-size bytes] [-rotate-interval d] [-retain n] [-gzip] [-summary file] [-drain d]\n\t[-causal file] [-concurrent file] [-udp]\n\t[-rate-limit events/s] [-burst n] [-write-queue n] [-upstream host:port] [-peers host:port,...] [-relays host,...] [-relay-name name]\n\t[-tls-cert file -tls-key file -tls-ca file] [-trust names] <PORT_NUMBER>\n       ./logger report [-out dir] [-prefix name] [-title title] <LOG_FILE>\n       ./logger query [filters] [-top n | -per-minute] [-json] <LOG_FILE>...\n")
+		os.Exit(1)
+	}
+	if isError(setupTLS()) {
+		os.Exit(1)
+	}
+	if udpEnabled && tlsServerConfig != nil {
+		fmt.Fprintf(os.Stderr, "Logger: UDP cannot be authenticated, -udp and -tls-cert exclude each other\n")
+		os.Exit(1)
+	}
+	port := ":" + flag.Arg(0)
+	if relayName == "" {
+		host, _ := os.Hostname()
+		relayName = host + port
+	}
+	if upstreamAddr != "" {
+		addTarget(upstreamAddr, false)
+	}
+	for _, addr := range strings.Split(peerAddrs, ",") {
+		if addr != "" {
+			addTarget(addr, true)
+			isError(addPeerIPs(addr))
+		}
+	}
+	for _, host := range strings.Split(relayHosts, ",") {
+		if host != "" {
+			isError(addHostIPs(relayIPs, host))
+		}
+	}
 	ln, e := net.Listen("tcp", port)
 	if isError(e) {
 		return
 	}
+	if tlsServerConfig != nil {
+		ln = tls.NewListener(ln, tlsServerConfig)
+	}
 
-	file, err_f := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if udpEnabled {
+		udpConn, e = net.ListenPacket("udp", port)
+		if isError(e) {
+			return
+		}
+	}
+
+	var err_f error
+	file, err_f = openRotating(path)
 	if isError(err_f) {
 		return
 	}
 	defer file.Close()
+	if isError(openSeqFile(path)) {
+		return
+	}
+	defer func() { seqFile.Close() }() // replaced on rotation
+	writeQueue = make(chan writeReq, writeQueueSize)
+	go runWriter(nil)
+
+	if statsPath != "" {
+		statsFile, err_f = openRotating(statsPath)
+		if isError(err_f) {
+			return
+		}
+		defer statsFile.Close()
+	}
+	go runStats()
+	if metricsAddr != "" {
+		go runMetrics(metricsAddr)
+	}
+	if subscribePort != "" {
+		go runSubscribe(subscribePort)
+	}
 
-	for true {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go acceptConns(ln)
+	if udpConn != nil {
+		connsWg.Add(1)
+		go runUDP(udpConn)
+	}
+	<-sigs
+	shutdown(ln)
+}
+
+func acceptConns(ln net.Listener) {
+	for {
 		conn, err := ln.Accept()
-		_ = err
-		go handleConn(conn, file, err_f)
+		connsMtx.Lock()
+		if shuttingDown {
+			connsMtx.Unlock()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		if isError(err) {
+			connsMtx.Unlock()
+			continue
+		}
+		openConns[conn] = true
+		connsWg.Add(1)
+		connsMtx.Unlock()
+		go handleConn(conn, atomic.AddInt64(&nextConnID, 1))
+	}
+}
+
+// shutdown stops accepting, lets every connection read what is already on
+// its way for drainTimeout, then flushes the logs and writes the summary
+func shutdown(ln net.Listener) {
+	fmt.Printf("%f - shutting down\n", getTime())
+	stopRelay()
+	connsMtx.Lock()
+	shuttingDown = true
+	ln.Close()
+	if udpConn != nil {
+		udpConn.Close()
+	}
+	deadline := time.Now().Add(drainTimeout)
+	for conn := range openConns {
+		conn.SetReadDeadline(deadline)
+	}
+	connsMtx.Unlock()
+	connsWg.Wait()
+	drainRelay(drainTimeout)
+
+	flushStats(math.MaxInt64)
+	flushWrites()
+	cleanWg.Wait()
+	isError(file.Sync())
+	isError(seqFile.Sync())
+	if statsFile != nil {
+		isError(statsFile.Sync())
 	}
+	writeSummary()
+	reportMissing()
+	writeClockReports()
 }
 
 func isError(err error) bool {
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	Logical clocks
+		node -> logger: [timestamp] [node name] [event] seq=[seq] lc=[lamport] vc=[name:count,...]
+		logger -> node: ACK [seq] lc=[lamport] vc=[name:count,...]
+	The logger merges the clocks of every logged event into its own and
+	sends them back with the ack, so nodes learn what the logger has seen.
+
+	On shutdown, if requested
+		-causal		every clocked event ordered by (lamport, node, seq), which
+					respects happened-before
+			text: [lamport] [node] [seq] [client timestamp] [event] [vc]
+			json: Record
+		-concurrent	every pair of events from different nodes whose vector
+					clocks are not ordered
+			[node]:[seq] [node]:[seq]
+*/
+
+var causalPath, concurrentPath string
+
+var clockMtx sync.Mutex
+var loggerLamport int64
+var mergedVC = make(map[string]int64)
+var clockedRecords []Record
+
+func parseVClock(s string) map[string]int64 {
+	if s == "" {
+		return nil
+	}
+	vc := make(map[string]int64)
+	for _, entry := range strings.Split(s, ",") {
+		i := strings.LastIndexByte(entry, ':')
+		if i <= 0 {
+			continue
+		}
+		if count, err := strconv.ParseInt(entry[i+1:], 10, 64); err == nil {
+			vc[entry[:i]] = count
+		}
+	}
+	return vc
+}
+
+// vcLeq reports whether a <= b entry by entry
+func vcLeq(a, b map[string]int64) bool {
+	for name, count := range a {
+		if count > b[name] {
+			return false
+		}
+	}
+	return true
+}
+
+func clockStamp() string {
+	stamp := fmt.Sprintf("lc=%d", loggerLamport)
+	if len(mergedVC) > 0 {
+		stamp += " vc=" + formatVClock(mergedVC)
+	}
+	return stamp
+}
+
+// mergeClocks folds the clocks of a logged event into the logger's clocks
+// and returns the stamps to send back with its ack
+func mergeClocks(rec Record) string {
+	clockMtx.Lock()
+	defer clockMtx.Unlock()
+	if rec.Lamport == 0 {
+		return clockStamp()
+	}
+	if rec.Lamport > loggerLamport {
+		loggerLamport = rec.Lamport
+	}
+	loggerLamport++
+	for name, count := range rec.VClock {
+		if count > mergedVC[name] {
+			mergedVC[name] = count
+		}
+	}
+	if causalPath != "" || concurrentPath != "" {
+		clockedRecords = append(clockedRecords, rec)
+	}
+	return clockStamp()
+}
+
+// currentClocks returns the logger's clocks without merging anything
+func currentClocks() string {
+	clockMtx.Lock()
+	defer clockMtx.Unlock()
+	return clockStamp()
+}
+
+func sortedClockedRecords() []Record {
+	recs := append([]Record{}, clockedRecords...)
+	sort.SliceStable(recs, func(i, j int) bool {
+		if recs[i].Lamport != recs[j].Lamport {
+			return recs[i].Lamport < recs[j].Lamport
+		}
+		if recs[i].Node != recs[j].Node {
+			return recs[i].Node < recs[j].Node
+		}
+		return recs[i].Seq < recs[j].Seq
+	})
+	return recs
+}
+
+func writeCausal(recs []Record) {
+	f, err := os.OpenFile(causalPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if isError(err) {
+		return
+	}
+	defer f.Close()
+	w := &strings.Builder{}
+	for _, rec := range recs {
+		if logFormat == formatJSON {
+			b, err := json.Marshal(rec)
+			if isError(err) {
+				continue
+			}
+			w.Write(b)
+			w.WriteByte('\n')
+		} else {
+			fmt.Fprintf(w, "%d %s %d %f %s %s\n", rec.Lamport, rec.Node, rec.Seq, rec.ClientTS, rec.Msg, formatVClock(rec.VClock))
+		}
+	}
+	f.WriteString(w.String())
+	f.Sync()
+}
+
+// writeConcurrent lists the pairs of vector-clocked events that are not
+// causally related; recs must be in causal order, so a later event can
+// never happen before an earlier one
+func writeConcurrent(recs []Record) {
+	f, err := os.OpenFile(concurrentPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if isError(err) {
+		return
+	}
+	defer f.Close()
+	w := &strings.Builder{}
+	pairs := 0
+	for i := range recs {
+		if recs[i].VClock == nil {
+			continue
+		}
+		for j := i + 1; j < len(recs); j++ {
+			if recs[j].VClock == nil || recs[i].Node == recs[j].Node {
+				continue
+			}
+			if !vcLeq(recs[i].VClock, recs[j].VClock) {
+				fmt.Fprintf(w, "%s:%d %s:%d\n", recs[i].Node, recs[i].Seq, recs[j].Node, recs[j].Seq)
+				pairs++
+			}
+		}
+	}
+	f.WriteString(w.String())
+	f.Sync()
+	fmt.Printf("CONCURRENT %d pairs\n", pairs)
+}
+
+// writeClockReports writes the causal order and concurrent pairs requested
+func writeClockReports() {
+	clockMtx.Lock()
+	recs := sortedClockedRecords()
+	clockMtx.Unlock()
+	if causalPath != "" {
+		writeCausal(recs)
+	}
+	if concurrentPath != "" {
+		writeConcurrent(recs)
+	}
+}
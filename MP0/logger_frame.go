@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+	Compressed batches, sent by ./node -compress
+		Z [count] [length]\n[length bytes of DEFLATE data]
+	The data holds count event lines, exactly as they would be sent one by
+	one. Each event is logged on its own with its own delay; its bytes are
+	the length of its line and its wire bytes its share of the whole frame
+	(header included), so wire bytes add up to what was received.
+	Uncompressed batches are plain event lines and need no frame.
+	Frames longer than maxFrameLength, compressed or inflated, are refused.
+*/
+
+const maxFrameLength = 16 << 20
+
+// parseFrameHeader reads "Z [count] [length]"
+func parseFrameHeader(header string) (int, int, error) {
+	fields := strings.Fields(header)
+	if len(fields) != 3 || fields[0] != "Z" {
+		return 0, 0, fmt.Errorf("Logger: malformed frame header %q", header)
+	}
+	count, err1 := strconv.Atoi(fields[1])
+	length, err2 := strconv.Atoi(fields[2])
+	if err1 != nil || err2 != nil || count < 1 || length < 0 || length > maxFrameLength {
+		return 0, 0, fmt.Errorf("Logger: malformed frame header %q", header)
+	}
+	return count, length, nil
+}
+
+// decodeFrame inflates a frame payload into its event lines
+func decodeFrame(count int, payload []byte) ([]string, error) {
+	zr := flate.NewReader(bytes.NewReader(payload))
+	data, err := io.ReadAll(io.LimitReader(zr, maxFrameLength+1))
+	if err != nil {
+		return nil, fmt.Errorf("Logger: cannot inflate frame: %v", err)
+	}
+	if len(data) > maxFrameLength {
+		return nil, fmt.Errorf("Logger: frame inflates to more than %d bytes", maxFrameLength)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) != count {
+		return nil, fmt.Errorf("Logger: frame announced %d events, held %d", count, len(lines))
+	}
+	return lines, nil
+}
+
+// readFrame reads the payload following header from r
+func readFrame(header string, r io.Reader) ([]string, int, error) {
+	count, length, err := parseFrameHeader(header)
+	if err != nil {
+		return nil, 0, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, err
+	}
+	lines, err := decodeFrame(count, payload)
+	return lines, len(header) + length, err
+}
+
+// wireShares splits the wire bytes of a frame over its events
+func wireShares(total int, count int) []int {
+	shares := make([]int, count)
+	for i := range shares {
+		shares[i] = total / count
+	}
+	shares[0] += total % count
+	return shares
+}
+
+// handleFrame logs every event of the compressed frame that follows header
+func handleFrame(nc *nodeConn, header string, r io.Reader, timestampS float64) error {
+	lines, wire, err := readFrame(header, r)
+	if err != nil {
+		return err
+	}
+	shares := wireShares(wire, len(lines))
+	for i, line := range lines {
+		fmt.Print(line)
+		_, _, err := handleEvent(nc, line, timestampS, shares[i])
+		isError(err)
+	}
+	return nil
+}
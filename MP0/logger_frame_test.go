@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseFrameHeader(t *testing.T) {
+	tests := []struct {
+		header     string
+		wantCount  int
+		wantLength int
+		wantErr    bool
+	}{
+		{"Z 3 120\n", 3, 120, false},
+		{"Z 1 0\n", 1, 0, false},
+		{"Z 0 120\n", 0, 0, true},
+		{"Z 3 -1\n", 0, 0, true},
+		{fmt.Sprintf("Z 3 %d\n", maxFrameLength+1), 0, 0, true},
+		{"Z 3\n", 0, 0, true},
+		{"Y 3 120\n", 0, 0, true},
+		{"Z x 120\n", 0, 0, true},
+	}
+	for _, tt := range tests {
+		count, length, err := parseFrameHeader(tt.header)
+		if (err != nil) != tt.wantErr || count != tt.wantCount || length != tt.wantLength {
+			t.Errorf("parseFrameHeader(%q) = %d, %d, %v, want %d, %d, error %v",
+				tt.header, count, length, err, tt.wantCount, tt.wantLength, tt.wantErr)
+		}
+	}
+}
+
+// framePayload strips the header off a frame made by compressFrame
+func framePayload(frame []byte) []byte {
+	return frame[bytes.IndexByte(frame, '\n')+1:]
+}
+
+func TestDecodeFrame(t *testing.T) {
+	lines := []string{"1.0 node1 a seq=1\n", "1.1 node1 b seq=2\n", "1.2 node1 c seq=3\n"}
+	tests := []struct {
+		name    string
+		count   int
+		payload []byte
+		want    []string
+		wantErr bool
+	}{
+		{"whole frame", 3, framePayload(compressFrame(lines)), lines, false},
+		{"one line", 1, framePayload(compressFrame(lines[:1])), lines[:1], false},
+		{"count too high", 4, framePayload(compressFrame(lines)), nil, true},
+		{"count too low", 2, framePayload(compressFrame(lines)), nil, true},
+		{"not deflate", 3, []byte("1.0 node1 a seq=1\n"), nil, true},
+		{"inflates too far", 1, framePayload(compressFrame([]string{strings.Repeat("x", maxFrameLength) + "\n"})), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeFrame(tt.count, tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if strings.Join(got, "") != strings.Join(tt.want, "") {
+				t.Errorf("lines %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	lines := []string{"1.0 node1 a seq=1\n", "1.1 node1 b seq=2\n"}
+	frame := compressFrame(lines)
+	payload := framePayload(frame)
+	header := string(frame[:len(frame)-len(payload)])
+	rest := "1.2 node1 c seq=3\n"
+	r := bytes.NewReader(append(append([]byte{}, payload...), rest...))
+	got, wire, err := readFrame(header, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, "") != strings.Join(lines, "") || wire != len(header)+len(payload) {
+		t.Errorf("lines %q wire %d, want %q wire %d", got, wire, lines, len(header)+len(payload))
+	}
+	if r.Len() != len(rest) {
+		t.Errorf("%d bytes left after the frame, want %d", r.Len(), len(rest))
+	}
+	if _, _, err := readFrame(header, bytes.NewReader(payload[:len(payload)-1])); err == nil {
+		t.Error("truncated frame read without error")
+	}
+}
+
+func TestWireShares(t *testing.T) {
+	tests := []struct {
+		total int
+		count int
+		want  []int
+	}{
+		{10, 1, []int{10}},
+		{10, 2, []int{5, 5}},
+		{10, 3, []int{4, 3, 3}},
+		{2, 3, []int{2, 0, 0}},
+	}
+	for _, tt := range tests {
+		got := wireShares(tt.total, tt.count)
+		sum := 0
+		for _, n := range got {
+			sum += n
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) || sum != tt.total {
+			t.Errorf("wireShares(%d, %d) = %v, want %v", tt.total, tt.count, got, tt.want)
+		}
+	}
+}
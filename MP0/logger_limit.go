@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	Per-node rate limit (-rate-limit [events/s] -burst [n])
+		Every node name has a token bucket holding up to burst events and
+		refilled at rate-limit per second. An event over the limit
+			TCP: waits for its token, which slows down reading from that
+				 node's connection only (throttled)
+			UDP: is dropped, the datagram reader is shared (dropped)
+		Replays of events already logged are acked without taking a token.
+		Relays and peers forward under the original node names, so the
+		limit is per node wherever its events come from.
+
+	Log writes go through a bounded queue (-write-queue [n] records) to a
+	single writer goroutine, so connections never wait on each other for
+	the log file; only a full queue, i.e. a disk that cannot keep up,
+	holds every connection back. TCP nodes are acked once their event is
+	written, so an event acked before the logger is killed is never lost.
+*/
+
+var rateLimit float64
+var burst int
+var writeQueueSize int
+
+// bucket : token bucket and counters of one node
+type bucket struct {
+	tokens    float64
+	last      time.Time
+	throttled int64
+	dropped   int64
+}
+
+var limitMtx sync.Mutex
+var buckets = make(map[string]*bucket) // key: node name
+
+func getBucket(node string) *bucket {
+	b, ok := buckets[node]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: time.Now()}
+		buckets[node] = b
+	}
+	return b
+}
+
+// admit takes a token for one event of node, waiting for it if wait is
+// set; it reports false when the event is dropped instead
+func admit(node string, wait bool) bool {
+	if rateLimit <= 0 {
+		return true
+	}
+	limitMtx.Lock()
+	b := getBucket(node)
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * rateLimit
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		limitMtx.Unlock()
+		return true
+	}
+	if !wait {
+		b.dropped++
+		limitMtx.Unlock()
+		return false
+	}
+	// reserve the next token, concurrent connections of the node queue up
+	b.tokens--
+	b.throttled++
+	delay := time.Duration(-b.tokens / rateLimit * float64(time.Second))
+	limitMtx.Unlock()
+	time.Sleep(delay)
+	return true
+}
+
+// limitCounts returns the throttled and dropped events of node
+func limitCounts(node string) (int64, int64) {
+	limitMtx.Lock()
+	defer limitMtx.Unlock()
+	if node == clusterName {
+		var throttled, dropped int64
+		for _, b := range buckets {
+			throttled += b.throttled
+			dropped += b.dropped
+		}
+		return throttled, dropped
+	}
+	if b, ok := buckets[node]; ok {
+		return b.throttled, b.dropped
+	}
+	return 0, 0
+}
+
+// writeReq : one entry for the log file and its line for the seq file
+// (see logger_seq.go), none for a flush; done is closed once written
+type writeReq struct {
+	out     string
+	seqLine string
+	done    chan struct{}
+}
+
+var writeQueue chan writeReq
+
+// flushWrites returns once everything queued before it is written
+func flushWrites() {
+	done := make(chan struct{})
+	writeQueue <- writeReq{done: done}
+	<-done
+}
+
+// runWriter is the only writer of the log file, until stop is closed
+func runWriter(stop <-chan struct{}) {
+	queue := writeQueue
+	for {
+		var req writeReq
+		select {
+		case req = <-queue:
+		case <-stop:
+			return
+		}
+		if req.out != "" {
+			rotations := file.rotations // only this goroutine writes file
+			_, err := file.WriteString(req.out)
+			if file.rotations != rotations && seqFile != nil {
+				isError(compactSeqFile())
+			}
+			if !isError(err) && req.seqLine != "" && seqFile != nil {
+				_, err = seqFile.WriteString(req.seqLine)
+				isError(err)
+			}
+		}
+		if req.done != nil {
+			close(req.done)
+		}
+	}
+}
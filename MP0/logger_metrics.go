@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	Metrics endpoint (-metrics [addr]), Prometheus text exposition format
+		GET /metrics
+			mp0_connected_nodes
+			mp0_events_total{node}
+			mp0_bytes_total{node}
+			mp0_wire_bytes_total{node}		// bytes on the wire, after compression
+			mp0_throttled_total{node}		// events delayed by the rate limit
+			mp0_dropped_total{node}			// events dropped by the rate limit
+			mp0_bytes_per_second{node}		// bytes of the last full second
+			mp0_delay_seconds{node}			// histogram of corrected delays
+*/
+
+var metricsAddr string
+
+var delayBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// nodeMetrics : counters of one node
+type nodeMetrics struct {
+	events   int64
+	bytes    int64
+	wire     int64
+	second   int64 // second of cur
+	cur      int64 // bytes received in second
+	prev     int64 // bytes received in second - 1
+	buckets  []int64
+	delaySum float64
+}
+
+var metricsMtx sync.Mutex
+var connectedNodes int64
+var metrics = make(map[string]*nodeMetrics)
+
+func getNodeMetrics(node string) *nodeMetrics {
+	nm, ok := metrics[node]
+	if !ok {
+		nm = &nodeMetrics{buckets: make([]int64, len(delayBuckets))}
+		metrics[node] = nm
+	}
+	return nm
+}
+
+// addBytes counts bytes in the second they were received in
+func (nm *nodeMetrics) addBytes(second int64, n int64) {
+	if second != nm.second {
+		if second == nm.second+1 {
+			nm.prev = nm.cur
+		} else {
+			nm.prev = 0
+		}
+		nm.cur = 0
+		nm.second = second
+	}
+	nm.cur += n
+	nm.bytes += n
+}
+
+// bytesPerSecond returns the bytes received in the second before now
+func (nm *nodeMetrics) bytesPerSecond(now int64) int64 {
+	switch now {
+	case nm.second:
+		return nm.prev
+	case nm.second + 1:
+		return nm.cur
+	}
+	return 0
+}
+
+// observe updates the metrics with one logged record
+func observe(rec Record) {
+	metricsMtx.Lock()
+	defer metricsMtx.Unlock()
+	switch rec.Type {
+	case "connected":
+		connectedNodes++
+	case "disconnected":
+		connectedNodes--
+		return
+	}
+	for _, node := range []string{rec.Node, clusterName} {
+		nm := getNodeMetrics(node)
+		nm.addBytes(int64(rec.ServerTS), int64(rec.Bytes))
+		nm.wire += int64(rec.WireBytes)
+		if rec.Type != "event" {
+			continue
+		}
+		nm.events++
+		nm.delaySum += rec.CorDelay
+		for i, le := range delayBuckets {
+			if rec.CorDelay <= le {
+				nm.buckets[i]++
+			}
+		}
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().Unix()
+	metricsMtx.Lock()
+	defer metricsMtx.Unlock()
+	var names []string
+	for node := range metrics {
+		names = append(names, node)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP mp0_connected_nodes Number of connected nodes.\n")
+	fmt.Fprintf(w, "# TYPE mp0_connected_nodes gauge\n")
+	fmt.Fprintf(w, "mp0_connected_nodes %d\n", connectedNodes)
+
+	fmt.Fprintf(w, "# HELP mp0_events_total Events logged per node, node \"*\" is the cluster.\n")
+	fmt.Fprintf(w, "# TYPE mp0_events_total counter\n")
+	for _, node := range names {
+		fmt.Fprintf(w, "mp0_events_total{node=%q} %d\n", node, metrics[node].events)
+	}
+
+	fmt.Fprintf(w, "# HELP mp0_bytes_total Bytes received per node.\n")
+	fmt.Fprintf(w, "# TYPE mp0_bytes_total counter\n")
+	for _, node := range names {
+		fmt.Fprintf(w, "mp0_bytes_total{node=%q} %d\n", node, metrics[node].bytes)
+	}
+
+	fmt.Fprintf(w, "# HELP mp0_wire_bytes_total Bytes received per node as sent on the wire.\n")
+	fmt.Fprintf(w, "# TYPE mp0_wire_bytes_total counter\n")
+	for _, node := range names {
+		fmt.Fprintf(w, "mp0_wire_bytes_total{node=%q} %d\n", node, metrics[node].wire)
+	}
+
+	fmt.Fprintf(w, "# HELP mp0_throttled_total Events delayed by the per-node rate limit.\n")
+	fmt.Fprintf(w, "# TYPE mp0_throttled_total counter\n")
+	for _, node := range names {
+		throttled, _ := limitCounts(node)
+		fmt.Fprintf(w, "mp0_throttled_total{node=%q} %d\n", node, throttled)
+	}
+
+	fmt.Fprintf(w, "# HELP mp0_dropped_total Events dropped by the per-node rate limit.\n")
+	fmt.Fprintf(w, "# TYPE mp0_dropped_total counter\n")
+	for _, node := range names {
+		_, dropped := limitCounts(node)
+		fmt.Fprintf(w, "mp0_dropped_total{node=%q} %d\n", node, dropped)
+	}
+
+	fmt.Fprintf(w, "# HELP mp0_bytes_per_second Bytes received per node in the last full second.\n")
+	fmt.Fprintf(w, "# TYPE mp0_bytes_per_second gauge\n")
+	for _, node := range names {
+		fmt.Fprintf(w, "mp0_bytes_per_second{node=%q} %d\n", node, metrics[node].bytesPerSecond(now))
+	}
+
+	fmt.Fprintf(w, "# HELP mp0_delay_seconds Corrected event delay per node.\n")
+	fmt.Fprintf(w, "# TYPE mp0_delay_seconds histogram\n")
+	for _, node := range names {
+		nm := metrics[node]
+		for i, le := range delayBuckets {
+			fmt.Fprintf(w, "mp0_delay_seconds_bucket{node=%q,le=\"%s\"} %d\n", node, formatFloat(le), nm.buckets[i])
+		}
+		fmt.Fprintf(w, "mp0_delay_seconds_bucket{node=%q,le=\"+Inf\"} %d\n", node, nm.events)
+		fmt.Fprintf(w, "mp0_delay_seconds_sum{node=%q} %s\n", node, formatFloat(nm.delaySum))
+		fmt.Fprintf(w, "mp0_delay_seconds_count{node=%q} %d\n", node, nm.events)
+	}
+}
+
+// runMetrics serves /metrics on addr
+func runMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	isError(http.ListenAndServe(addr, mux))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Query tool
+		./logger query [filters] [-top n | -per-minute] [-json] [log file ...]
+	Reads text or json logs (gzipped if they end in .gz, e.g. rotated ones)
+	and prints the events that pass every filter
+		-node [pattern]		shell pattern on the node name
+		-from, -to [time]	event timestamp range, unix seconds or RFC 3339
+		-min-delay, -max-delay [seconds]	corrected delay range
+	one per line, oldest first
+		[timestamp] [node] [event] [delay] [corrected delay] [bytes]
+	or as json records with -json. Instead of the events
+		-top [n]		the n slowest events, slowest first
+		-per-minute		events per node per minute (UTC), one row per minute
+*/
+
+// queryFilter : what an event must match to be printed
+type queryFilter struct {
+	node               string
+	from, to           float64
+	minDelay, maxDelay float64
+}
+
+func (q *queryFilter) match(rec Record) bool {
+	if rec.Type != "event" {
+		return false
+	}
+	if ok, _ := filepath.Match(q.node, rec.Node); !ok {
+		return false
+	}
+	return rec.ClientTS >= q.from && rec.ClientTS <= q.to &&
+		rec.CorDelay >= q.minDelay && rec.CorDelay <= q.maxDelay
+}
+
+// parseQueryTime reads unix seconds or an RFC 3339 time
+func parseQueryTime(s string, def float64) (float64, error) {
+	if s == "" {
+		return def, nil
+	}
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		return v, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("Logger: bad time %q, want unix seconds or RFC 3339", s)
+	}
+	return float64(t.UnixNano()) / float64(time.Second), nil
+}
+
+func printEvents(recs []Record, asJSON bool) {
+	for _, rec := range recs {
+		if asJSON {
+			b, err := json.Marshal(rec)
+			if !isError(err) {
+				fmt.Println(string(b))
+			}
+			continue
+		}
+		fmt.Printf("%f %s %s %f %f %d\n", rec.ClientTS, rec.Node, rec.Msg, rec.Delay, rec.CorDelay, rec.Bytes)
+	}
+}
+
+// printPerMinute prints a table of events per node per minute
+func printPerMinute(recs []Record) {
+	counts := make(map[int64]map[string]int) // minute -> node -> events
+	nodeSet := make(map[string]bool)
+	for _, rec := range recs {
+		minute := int64(rec.ClientTS) / 60
+		if counts[minute] == nil {
+			counts[minute] = make(map[string]int)
+		}
+		counts[minute][rec.Node]++
+		nodeSet[rec.Node] = true
+	}
+	var nodes []string
+	for node := range nodeSet {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	var minutes []int64
+	for minute := range counts {
+		minutes = append(minutes, minute)
+	}
+	sort.Slice(minutes, func(i, j int) bool { return minutes[i] < minutes[j] })
+
+	fmt.Printf("minute\t%s\ttotal\n", strings.Join(nodes, "\t"))
+	for _, minute := range minutes {
+		row := []string{time.Unix(minute*60, 0).UTC().Format("2006-01-02 15:04")}
+		total := 0
+		for _, node := range nodes {
+			row = append(row, strconv.Itoa(counts[minute][node]))
+			total += counts[minute][node]
+		}
+		fmt.Printf("%s\t%d\n", strings.Join(row, "\t"), total)
+	}
+}
+
+// runQuery is "./logger query", it returns the exit code
+func runQuery(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	q := queryFilter{}
+	var from, to string
+	fs.StringVar(&q.node, "node", "*", "shell pattern on the node name")
+	fs.StringVar(&from, "from", "", "only events sent at or after this time (unix seconds or RFC 3339)")
+	fs.StringVar(&to, "to", "", "only events sent at or before this time (unix seconds or RFC 3339)")
+	fs.Float64Var(&q.minDelay, "min-delay", -1e9, "only events with at least this corrected delay (seconds)")
+	fs.Float64Var(&q.maxDelay, "max-delay", 1e9, "only events with at most this corrected delay (seconds)")
+	top := fs.Int("top", 0, "print the n slowest events instead")
+	perMinute := fs.Bool("per-minute", false, "print events per node per minute instead")
+	asJSON := fs.Bool("json", false, "print events as json records")
+	fs.Parse(args)
+	if fs.NArg() == 0 || *top < 0 || (*top > 0 && *perMinute) {
+		fmt.Fprintf(os.Stderr, "Usage: ./logger query [-node pattern] [-from time] [-to time] [-min-delay s] [-max-delay s]\n\t[-top n | -per-minute] [-json] <LOG_FILE>...\n")
+		return 1
+	}
+	if _, err := filepath.Match(q.node, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "Logger: bad node pattern %q\n", q.node)
+		return 1
+	}
+	var err error
+	if q.from, err = parseQueryTime(from, 0); isError(err) {
+		return 1
+	}
+	if q.to, err = parseQueryTime(to, 1e18); isError(err) {
+		return 1
+	}
+
+	var matched []Record
+	for _, logPath := range fs.Args() {
+		recs, err := readLog(logPath)
+		if isError(err) {
+			return 1
+		}
+		for _, rec := range recs {
+			if q.match(rec) {
+				matched = append(matched, rec)
+			}
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].ClientTS < matched[j].ClientTS })
+
+	switch {
+	case *top > 0:
+		sort.SliceStable(matched, func(i, j int) bool { return matched[i].CorDelay > matched[j].CorDelay })
+		if len(matched) > *top {
+			matched = matched[:*top]
+		}
+		printEvents(matched, *asJSON)
+	case *perMinute:
+		printPerMinute(matched)
+	default:
+		printEvents(matched, *asJSON)
+	}
+	return 0
+}
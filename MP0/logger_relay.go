@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Relay mode (-upstream [host:port])
+		A relay is a logger that also forwards every event it logs to a
+		parent logger, over one connection per node run that looks to the
+		parent like the node itself:
+			relay -> parent: [timestamp] - [node name] connected epoch=[epoch] next=[seq] via=[relays]
+			relay -> parent: [timestamp] [node name] [event] seq=[seq] ... off=[offset] via=[relays] hop=[send time]
+			parent -> relay: SYNC and ACK, answered and applied like a node does
+		The event timestamp, node name, seq and clocks are the node's own.
+		off is the offset of the node clock to the relay clock, via the
+		relays the event went through (nearest to the node first) and hop
+		the relay clock when the event was sent. The parent adds its own
+		offset to the relay, so its corrected delay is end to end, and
+		keeps the delay of the last hop apart (hop_delay in the json log).
+		off, via and hop are only honoured on TCP connections whose
+		handshake has via=, from a host in -relays or -peers, under TLS
+		from names in -trust instead; anyone else's are ignored.
+
+		The relay acks the node once the event is logged locally and keeps
+		it, up to relayBuffer events per node, until the parent acks it,
+		replaying it after a reconnect; the parent drops duplicates by seq.
+		A restarted node is forwarded on a new connection once everything of
+		its previous run is acked, so the parent sees the runs in order.
+
+	Peer replication (-peers [host:port,...])
+		Every event a node sends to this logger is also forwarded, the same
+		way, to every peer, whose handshakes carry replica=1. Events received
+		from a peer are logged but forwarded nowhere, so replicas do not
+		loop. A node that fails over to a peer replays its unacked events,
+		which the peer already has by seq and drops. A peer that is down
+		only holds relayBuffer events per node, newer ones are dropped.
+		replica=1 is only honoured on TCP connections from an address of a
+		host in -peers, under TLS only from names in -trust; anyone
+		else is treated as a node and forwarded like one.
+*/
+
+const relayBuffer int = 10000
+
+var upstreamAddr string
+var peerAddrs string
+var relayHosts string
+var relayName string
+
+// target : a logger events are forwarded to, the parent or a peer
+type target struct {
+	addr       string
+	replica    bool
+	forwarders map[string]*forwarder // key: node name, latest run
+	all        []*forwarder
+	dropped    int
+}
+
+var targets []*target
+var peerIPs = make(map[string]bool)  // addresses of the hosts in -peers
+var relayIPs = make(map[string]bool) // addresses of the hosts in -relays
+
+// addTarget forwards events to addr from now on
+func addTarget(addr string, replica bool) {
+	targets = append(targets, &target{addr: addr, replica: replica, forwarders: make(map[string]*forwarder)})
+}
+
+// addHostIPs adds the addresses of host to ips
+func addHostIPs(ips map[string]bool, host string) error {
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range addrs {
+		ips[net.ParseIP(ip).String()] = true
+	}
+	return nil
+}
+
+// addPeerIPs lets the host of peer addr send replica=1
+func addPeerIPs(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	return addHostIPs(peerIPs, host)
+}
+
+// fromHost reports whether nc comes over TCP from one of ips
+func fromHost(nc *nodeConn, ips map[string]bool) bool {
+	conn, ok := nc.conn.(net.Conn) // never UDP
+	if !ok {
+		return false
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	return err == nil && ips[net.ParseIP(host).String()]
+}
+
+// mayReplicate tells whether nc may be a peer replicating its events
+func mayReplicate(nc *nodeConn) bool {
+	if tlsServerConfig != nil {
+		return trustedNames[nc.identity]
+	}
+	return fromHost(nc, peerIPs)
+}
+
+// mayRelay tells whether nc may forward events of other nodes with their
+// relay options
+func mayRelay(nc *nodeConn) bool {
+	if tlsServerConfig != nil {
+		return trustedNames[nc.identity]
+	}
+	return fromHost(nc, relayIPs) || fromHost(nc, peerIPs)
+}
+
+// relayEvent : one event waiting for the parent's ack
+type relayEvent struct {
+	seq  int64
+	line string // without hop= and the newline
+}
+
+// forwarder : forwards the events of one run of a node to a target,
+// protected by relayMtx
+type forwarder struct {
+	t        *target
+	name     string
+	epoch    string
+	via      string // relays below this one, from the handshake
+	next     int64
+	pending  []relayEvent
+	unsorted bool     // UDP events came out of seq order
+	sent     int      // pending[:sent] were written on conn
+	conn     net.Conn // nil while disconnected
+	writeMtx sync.Mutex
+	retired  bool       // a newer run of the node took over
+	prev     *forwarder // older run, forwarded first
+	drained  chan struct{}
+}
+
+var relayMtx sync.Mutex
+var relayCond = sync.NewCond(&relayMtx)
+var relayStopping bool
+
+// joinVia appends this relay to the relays an event went through
+func joinVia(via string) string {
+	if via == "" {
+		return relayName
+	}
+	return via + "," + relayName
+}
+
+// getForwarder returns the forwarder of the current run of node to t,
+// starting a new one when the epoch changes; protected by relayMtx
+func (t *target) getForwarder(node string, epoch string) *forwarder {
+	f, ok := t.forwarders[node]
+	if ok && (epoch == "" || f.epoch == epoch) {
+		return f
+	}
+	nf := &forwarder{t: t, name: node, epoch: epoch, drained: make(chan struct{})}
+	if ok {
+		f.retired = true
+		nf.prev = f
+		relayCond.Broadcast()
+	}
+	t.forwarders[node] = nf
+	t.all = append(t.all, nf)
+	go nf.run()
+	return nf
+}
+
+// forwardHello passes the handshake of a node on to its forwarders
+func forwardHello(node string, opts map[string]string) {
+	relayMtx.Lock()
+	defer relayMtx.Unlock()
+	for _, t := range targets {
+		f := t.getForwarder(node, opts["epoch"])
+		f.via = opts["via"]
+		if next := parseSeq(opts, "next"); next > f.next {
+			f.next = next
+		}
+	}
+}
+
+// relayLine rewrites an event line for the parent: the relay options of
+// the relay below are replaced by ours
+func relayLine(rec Record, dat string) string {
+	var fields []string
+	for _, f := range strings.Fields(dat) {
+		if !strings.HasPrefix(f, "off=") && !strings.HasPrefix(f, "via=") && !strings.HasPrefix(f, "hop=") {
+			fields = append(fields, f)
+		}
+	}
+	fields = append(fields, fmt.Sprintf("off=%f", rec.Offset), "via="+joinVia(rec.Relay))
+	return strings.Join(fields, " ")
+}
+
+// forward queues a logged event for every target; if wait is set it waits
+// while the node's buffer for the parent is full, otherwise (the shared
+// UDP reader) a full buffer drops the event, as does a full buffer for a
+// peer or any full buffer once the logger shuts down
+func forward(rec Record, dat string, wait bool) {
+	if len(targets) == 0 {
+		return
+	}
+	line := relayLine(rec, dat)
+	relayMtx.Lock()
+	defer relayMtx.Unlock()
+	for _, t := range targets {
+		f := t.getForwarder(rec.Node, "")
+		for len(f.pending) >= relayBuffer && wait && !t.replica && !relayStopping {
+			relayCond.Wait()
+		}
+		if len(f.pending) >= relayBuffer {
+			t.dropped++
+			continue
+		}
+		if n := len(f.pending); n > 0 && rec.Seq < f.pending[n-1].seq {
+			f.unsorted = true
+		}
+		f.pending = append(f.pending, relayEvent{seq: rec.Seq, line: line})
+		if rec.Seq >= f.next {
+			f.next = rec.Seq + 1
+		}
+	}
+	relayCond.Broadcast()
+}
+
+func (f *forwarder) write(conn net.Conn, msg string) error {
+	f.writeMtx.Lock()
+	defer f.writeMtx.Unlock()
+	_, err := fmt.Fprint(conn, msg)
+	return err
+}
+
+// disconnect drops conn if it is still the current one, protected by relayMtx
+func (f *forwarder) disconnect(conn net.Conn) {
+	if f.conn == conn {
+		f.conn = nil
+		conn.Close()
+	}
+	relayCond.Broadcast()
+}
+
+func relaySeq(ev relayEvent) int64 { return ev.seq }
+
+// ack drops the pending event seq, protected by relayMtx
+func (f *forwarder) ack(seq int64) {
+	f.pending, f.sent = ackPending(f.pending, f.sent, relaySeq, f.unsorted, seq)
+	if len(f.pending) == 0 {
+		f.unsorted = false
+	}
+	relayCond.Broadcast()
+}
+
+// readUpstream answers clock offset probes and applies acks of the parent
+func (f *forwarder) readUpstream(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		dat, err := reader.ReadString('\n')
+		if err != nil {
+			relayMtx.Lock()
+			f.disconnect(conn)
+			relayMtx.Unlock()
+			return
+		}
+		t2 := getTime()
+		fields := strings.Fields(dat)
+		if len(fields) == 3 && fields[0] == "SYNC" {
+			f.write(conn, fmt.Sprintf("SYNC %s %s %f %f\n", fields[1], fields[2], t2, getTime()))
+		} else if len(fields) >= 2 && fields[0] == "ACK" {
+			if seq, e := strconv.ParseInt(fields[1], 10, 64); e == nil {
+				relayMtx.Lock()
+				f.ack(seq)
+				relayMtx.Unlock()
+			}
+		}
+	}
+}
+
+func (f *forwarder) hello() string {
+	relayMtx.Lock()
+	defer relayMtx.Unlock()
+	msg := fmt.Sprintf("%f - %s connected", getTime(), f.name)
+	if f.epoch != "" {
+		msg += " epoch=" + f.epoch
+	}
+	msg += fmt.Sprintf(" next=%d via=%s", f.next, joinVia(f.via))
+	if f.t.replica {
+		msg += " replica=1"
+	}
+	return msg + "\n"
+}
+
+// sendPending writes pending events, starting from the oldest unacked one,
+// until conn breaks; it returns true once the run is retired and acked
+func (f *forwarder) sendPending(conn net.Conn) bool {
+	relayMtx.Lock()
+	defer relayMtx.Unlock()
+	for {
+		for f.conn == conn && f.sent >= len(f.pending) && !(f.retired && len(f.pending) == 0) {
+			relayCond.Wait()
+		}
+		if f.conn != conn {
+			return false
+		}
+		if f.retired && len(f.pending) == 0 {
+			return true
+		}
+		ev := f.pending[f.sent]
+		if ev.seq == 0 {
+			// never acked, sent once
+			f.pending = append(f.pending[:f.sent], f.pending[f.sent+1:]...)
+			relayCond.Broadcast()
+		} else {
+			f.sent++
+		}
+		relayMtx.Unlock()
+		err := f.write(conn, fmt.Sprintf("%s hop=%f\n", ev.line, getTime()))
+		relayMtx.Lock()
+		if err != nil {
+			f.disconnect(conn)
+		}
+	}
+}
+
+// dialTarget retries with exponential backoff until the target accepts
+func dialTarget(t *target, node string) net.Conn {
+	backoff := 100 * time.Millisecond
+	for {
+		conn, err := dialTLS(t.addr)
+		if err == nil {
+			return conn
+		}
+		fmt.Fprintf(os.Stderr, "Logger: cannot reach %s for %s, retrying in %v\n", t.addr, node, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+}
+
+// run forwards the node run once the previous run is drained, reconnecting
+// to the target until this run is retired and acked
+func (f *forwarder) run() {
+	if f.prev != nil {
+		<-f.prev.drained
+	}
+	for {
+		conn := dialTarget(f.t, f.name)
+		relayMtx.Lock()
+		f.conn = conn
+		f.sent = 0
+		relayMtx.Unlock()
+		go f.readUpstream(conn)
+		done := f.write(conn, f.hello()) == nil && f.sendPending(conn)
+		relayMtx.Lock()
+		f.disconnect(conn)
+		relayMtx.Unlock()
+		if done {
+			close(f.drained)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Logger: lost connection to %s for %s, reconnecting\n", f.t.addr, f.name)
+	}
+}
+
+// stopRelay keeps forward from waiting for buffer space from now on
+func stopRelay() {
+	relayMtx.Lock()
+	relayStopping = true
+	relayCond.Broadcast()
+	relayMtx.Unlock()
+}
+
+// drainRelay gives the forwarders timeout to get their events acked and
+// reports what is left per target
+func drainRelay(timeout time.Duration) {
+	if len(targets) == 0 {
+		return
+	}
+	timer := time.AfterFunc(timeout, func() {
+		relayMtx.Lock()
+		relayCond.Broadcast()
+		relayMtx.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+	relayMtx.Lock()
+	defer relayMtx.Unlock()
+	for {
+		left := make([]int, len(targets))
+		total := 0
+		for i, t := range targets {
+			for _, f := range t.all {
+				left[i] += len(f.pending)
+			}
+			total += left[i]
+		}
+		if total == 0 || !time.Now().Before(deadline) {
+			for i, t := range targets {
+				kind := "upstream"
+				if t.replica {
+					kind = "peer"
+				}
+				fmt.Printf("RELAY %s=%s unforwarded=%d dropped=%d\n", kind, t.addr, left[i], t.dropped)
+			}
+			return
+		}
+		relayCond.Wait()
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRelayOptions(t *testing.T) {
+	const dat = "100.0 node1 ev seq=1 off=5.0 via=r1 hop=101.0\n"
+	tests := []struct {
+		name      string
+		relay     bool
+		wantOff   float64
+		wantRelay string
+	}{
+		{"relay", true, 5, "r1"},
+		{"node", false, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc := &nodeConn{name: "node1", relay: tt.relay}
+			rec, err := newRecord("event", nc, dat, 102)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Offset != tt.wantOff || rec.CorDelay != 2+tt.wantOff || rec.Relay != tt.wantRelay {
+				t.Errorf("offset %f corrected delay %f relay %q, want %f %f %q",
+					rec.Offset, rec.CorDelay, rec.Relay, tt.wantOff, 2+tt.wantOff, tt.wantRelay)
+			}
+		})
+	}
+}
+
+// TestTrustedHosts checks who may send replica=1 and relay options
+// without TLS
+func TestTrustedHosts(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	udpAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:5001")
+
+	defer func() { peerIPs, relayIPs = make(map[string]bool), make(map[string]bool) }()
+	tests := []struct {
+		name        string
+		peers       string
+		relays      string
+		conn        io.Writer
+		wantReplica bool
+		wantRelay   bool
+	}{
+		{"peer", "127.0.0.1:1234", "", server, true, true},
+		{"peer by name", "localhost:1234", "", server, true, true},
+		{"relay", "", "127.0.0.1", server, false, true},
+		{"relay by name", "", "localhost", server, false, true},
+		{"node", "", "", server, false, false},
+		{"udp", "127.0.0.1:1234", "127.0.0.1", &udpPeer{addr: udpAddr}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peerIPs, relayIPs = make(map[string]bool), make(map[string]bool)
+			if tt.peers != "" {
+				if err := addPeerIPs(tt.peers); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.relays != "" {
+				if err := addHostIPs(relayIPs, tt.relays); err != nil {
+					t.Fatal(err)
+				}
+			}
+			nc := &nodeConn{name: "node1", conn: tt.conn}
+			if got := mayReplicate(nc); got != tt.wantReplica {
+				t.Errorf("mayReplicate = %v, want %v", got, tt.wantReplica)
+			}
+			if got := mayRelay(nc); got != tt.wantRelay {
+				t.Errorf("mayRelay = %v, want %v", got, tt.wantRelay)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	Report generator, replaces graph.py
+		./logger report [-out dir] [-prefix name] [-title title] [log file]
+	Reads a text or json log (gzipped if it ends in .gz) and writes
+		[prefix]-delay.csv		second,count,min,median,p90,p99,max
+		[prefix]-bandwidth.csv	second,bytes
+		[prefix]-time.svg		min, max, median and p90 delay per second
+		[prefix]-bandwidth.svg	bytes per second
+	Like graph.py, seconds count from the first client timestamp, every
+	event and connect is counted in the second it was sent, delays are the
+	corrected ones when logged and bytes are event bytes, not wire bytes.
+	Records sent more than half of maxReportSpan away from the median are
+	skipped with a warning, a node clock that far off is broken.
+	prefix defaults to the log file name without extension, e.g. 8.txt
+	gives 8-time.svg next to graphs/8-time.png.
+*/
+
+const maxReportSpan float64 = 7 * 24 * 3600 // seconds
+
+// secondStats : delays and bytes of the records sent in one second
+type secondStats struct {
+	delays []float64
+	bytes  int
+}
+
+// readTextLog reads the three-line entries of the text log
+func readTextLog(r *bufio.Reader) ([]Record, error) {
+	var recs []Record
+	for {
+		logLine, err := r.ReadString('\n')
+		if strings.TrimSpace(logLine) == "" {
+			if err == io.EOF {
+				return recs, nil
+			}
+			if err != nil {
+				return recs, err
+			}
+			continue
+		}
+		delayLine, err1 := r.ReadString('\n')
+		bytesLine, err2 := r.ReadString('\n')
+		delays := strings.Fields(delayLine)
+		sizes := strings.Fields(bytesLine)
+		if (err1 != nil && err1 != io.EOF) || (err2 != nil && err2 != io.EOF) || len(delays) == 0 || len(sizes) == 0 {
+			return recs, fmt.Errorf("Logger: truncated entry %q", logLine)
+		}
+		fields := strings.Fields(logLine)
+		ts, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return recs, fmt.Errorf("Logger: bad timestamp in %q", logLine)
+		}
+		rec := Record{Type: "event", ClientTS: ts}
+		if len(fields) == 4 && fields[1] == "-" {
+			rec.Type = fields[3]
+			rec.Node = fields[2]
+		} else if len(fields) >= 3 {
+			rec.Node = fields[1]
+			rec.Msg = fields[2]
+		}
+		rec.Delay, _ = strconv.ParseFloat(delays[0], 64)
+		rec.ServerTS = ts + rec.Delay
+		rec.CorDelay, _ = strconv.ParseFloat(delays[len(delays)-1], 64) // delay only in old logs
+		rec.Bytes, _ = strconv.Atoi(sizes[0])
+		rec.WireBytes = rec.Bytes
+		if len(sizes) > 1 {
+			rec.WireBytes, _ = strconv.Atoi(sizes[1])
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// readLog reads a text or json log, gzipped if path ends in .gz
+func readLog(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var in io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		in = gz
+	}
+	r := bufio.NewReader(in)
+	first, err := r.Peek(1)
+	if err != nil || first[0] != '{' {
+		return readTextLog(r)
+	}
+	var recs []Record
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			var rec Record
+			if e := json.Unmarshal(line, &rec); e != nil {
+				return recs, fmt.Errorf("Logger: bad json record %q", strings.TrimSpace(string(line)))
+			}
+			recs = append(recs, rec)
+		}
+		if err == io.EOF {
+			return recs, nil
+		}
+		if err != nil {
+			return recs, err
+		}
+	}
+}
+
+// perSecond groups connects and events by the second they were sent in,
+// counted from the first one; records sent more than maxReportSpan/2 from
+// the median are skipped, so one bad node clock cannot blow up the report
+func perSecond(recs []Record) []secondStats {
+	var sent []float64
+	for _, rec := range recs {
+		if rec.Type == "event" || rec.Type == "connected" {
+			sent = append(sent, rec.ClientTS)
+		}
+	}
+	if len(sent) == 0 {
+		return nil
+	}
+	sort.Float64s(sent)
+	median := sent[len(sent)/2] // NaNs sort first
+	lo, hi := median-maxReportSpan/2, median+maxReportSpan/2
+	start := math.Inf(1)
+	end := math.Inf(-1)
+	skipped := 0
+	for _, ts := range sent {
+		if !(ts >= lo && ts <= hi) { // NaN too
+			skipped++
+			continue
+		}
+		start = math.Min(start, ts)
+		end = math.Max(end, ts)
+	}
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "Logger: skipping %d records sent over %.0fs from the others\n", skipped, maxReportSpan/2)
+	}
+	seconds := make([]secondStats, int(end-start)+1)
+	for _, rec := range recs {
+		if (rec.Type != "event" && rec.Type != "connected") || !(rec.ClientTS >= lo && rec.ClientTS <= hi) {
+			continue
+		}
+		s := &seconds[int(rec.ClientTS-start)]
+		s.delays = append(s.delays, rec.CorDelay)
+		s.bytes += rec.Bytes
+	}
+	for i := range seconds {
+		sort.Float64s(seconds[i].delays)
+	}
+	return seconds
+}
+
+func writeFile(path string, content string) error {
+	err := os.WriteFile(path, []byte(content), 0666)
+	if err == nil {
+		fmt.Println(path)
+	}
+	return err
+}
+
+func delayCSV(seconds []secondStats) string {
+	var sb strings.Builder
+	sb.WriteString("second,count,min,median,p90,p99,max\n")
+	for i, s := range seconds {
+		n := len(s.delays)
+		if n == 0 {
+			fmt.Fprintf(&sb, "%d,0,0,0,0,0,0\n", i)
+			continue
+		}
+		fmt.Fprintf(&sb, "%d,%d,%f,%f,%f,%f,%f\n", i, n, s.delays[0], percentile(s.delays, 50),
+			percentile(s.delays, 90), percentile(s.delays, 99), s.delays[n-1])
+	}
+	return sb.String()
+}
+
+func bandwidthCSV(seconds []secondStats) string {
+	var sb strings.Builder
+	sb.WriteString("second,bytes\n")
+	for i, s := range seconds {
+		fmt.Fprintf(&sb, "%d,%d\n", i, s.bytes)
+	}
+	return sb.String()
+}
+
+// series : one line of a chart
+type series struct {
+	label string
+	ys    []float64
+}
+
+// chart colors, the matplotlib defaults used by graph.py
+var chartColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd"}
+
+// niceStep rounds raw up to 1, 2 or 5 times a power of ten
+func niceStep(raw float64) float64 {
+	if raw <= 0 {
+		return 1
+	}
+	mag := math.Pow(10, math.Floor(math.Log10(raw)))
+	for _, f := range []float64{1, 2, 5} {
+		if raw <= f*mag {
+			return f * mag
+		}
+	}
+	return 10 * mag
+}
+
+func formatTick(v float64) string {
+	return strconv.FormatFloat(v, 'g', 6, 64)
+}
+
+// lineChart draws series over x = 0, 1, 2, ... as an SVG document
+func lineChart(title, xLabel, yLabel string, lines []series) string {
+	const width, height = 960.0, 640.0
+	const left, right, top, bottom = 90.0, 30.0, 50.0, 60.0
+	plotW, plotH := width-left-right, height-top-bottom
+	title, xLabel, yLabel = html.EscapeString(title), html.EscapeString(xLabel), html.EscapeString(yLabel)
+
+	n, yMax := 0, 0.0
+	for _, l := range lines {
+		if len(l.ys) > n {
+			n = len(l.ys)
+		}
+		for _, y := range l.ys {
+			yMax = math.Max(yMax, y)
+		}
+	}
+	xMax := math.Max(float64(n-1), 1)
+	yStep := niceStep(yMax / 5)
+	yTop := math.Max(math.Ceil(yMax/yStep)*yStep, yStep)
+	xStep := niceStep(xMax / 10)
+	px := func(x float64) float64 { return left + x/xMax*plotW }
+	py := func(y float64) float64 { return top + plotH - y/yTop*plotH }
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%.0f\" height=\"%.0f\" font-family=\"sans-serif\" font-size=\"12\">\n", width, height)
+	fmt.Fprintf(&sb, "<rect width=\"100%%\" height=\"100%%\" fill=\"white\"/>\n")
+	fmt.Fprintf(&sb, "<text x=\"%.1f\" y=\"30\" text-anchor=\"middle\" font-size=\"16\">%s</text>\n", left+plotW/2, title)
+	for y := 0.0; y <= yTop+yStep/2; y += yStep {
+		fmt.Fprintf(&sb, "<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"#dddddd\"/>\n", left, py(y), left+plotW, py(y))
+		fmt.Fprintf(&sb, "<text x=\"%.1f\" y=\"%.1f\" text-anchor=\"end\">%s</text>\n", left-6, py(y)+4, formatTick(y))
+	}
+	for x := 0.0; x <= xMax; x += xStep {
+		fmt.Fprintf(&sb, "<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"black\"/>\n", px(x), top+plotH, px(x), top+plotH+5)
+		fmt.Fprintf(&sb, "<text x=\"%.1f\" y=\"%.1f\" text-anchor=\"middle\">%s</text>\n", px(x), top+plotH+20, formatTick(x))
+	}
+	fmt.Fprintf(&sb, "<rect x=\"%.1f\" y=\"%.1f\" width=\"%.1f\" height=\"%.1f\" fill=\"none\" stroke=\"black\"/>\n", left, top, plotW, plotH)
+	fmt.Fprintf(&sb, "<text x=\"%.1f\" y=\"%.1f\" text-anchor=\"middle\">%s</text>\n", left+plotW/2, height-15, xLabel)
+	fmt.Fprintf(&sb, "<text x=\"20\" y=\"%.1f\" text-anchor=\"middle\" transform=\"rotate(-90 20 %.1f)\">%s</text>\n", top+plotH/2, top+plotH/2, yLabel)
+
+	for i, l := range lines {
+		color := chartColors[i%len(chartColors)]
+		var points []string
+		for x, y := range l.ys {
+			points = append(points, fmt.Sprintf("%.1f,%.1f", px(float64(x)), py(y)))
+		}
+		fmt.Fprintf(&sb, "<polyline fill=\"none\" stroke=\"%s\" stroke-width=\"1.5\" points=\"%s\"/>\n", color, strings.Join(points, " "))
+		if l.label != "" {
+			ly := top + 20 + float64(i)*18
+			fmt.Fprintf(&sb, "<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"%s\" stroke-width=\"1.5\"/>\n", left+15, ly-4, left+40, ly-4, color)
+			fmt.Fprintf(&sb, "<text x=\"%.1f\" y=\"%.1f\">%s</text>\n", left+46, ly, html.EscapeString(l.label))
+		}
+	}
+	sb.WriteString("</svg>\n")
+	return sb.String()
+}
+
+func timeChart(seconds []secondStats, name string) string {
+	lines := []series{{label: "Minimum Delay"}, {label: "Maximum Delay"}, {label: "Median Delay"}, {label: "90 Percentile Delay"}}
+	for _, s := range seconds {
+		var min, max, med, p90 float64
+		if n := len(s.delays); n > 0 {
+			min, max = s.delays[0], s.delays[n-1]
+			med, p90 = percentile(s.delays, 50), percentile(s.delays, 90)
+		}
+		lines[0].ys = append(lines[0].ys, min)
+		lines[1].ys = append(lines[1].ys, max)
+		lines[2].ys = append(lines[2].ys, med)
+		lines[3].ys = append(lines[3].ys, p90)
+	}
+	return lineChart("Delay versus time ("+name+")", "Time (seconds)", "Delay (seconds)", lines)
+}
+
+func bandwidthChart(seconds []secondStats, name string) string {
+	line := series{}
+	for _, s := range seconds {
+		line.ys = append(line.ys, float64(s.bytes))
+	}
+	return lineChart("Total bandwidth in each second ("+name+")", "Time (seconds)",
+		"Bandwidth (message length in characters)", []series{line})
+}
+
+// runReport is "./logger report", it returns the exit code
+func runReport(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	outDir := fs.String("out", ".", "directory the tables and charts are written to")
+	prefix := fs.String("prefix", "", "output file name prefix (default log file name without extension)")
+	title := fs.String("title", "", "chart title suffix (default prefix)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: ./logger report [-out dir] [-prefix name] [-title title] <LOG_FILE>\n")
+		return 1
+	}
+	logPath := fs.Arg(0)
+	if *prefix == "" {
+		base := strings.TrimSuffix(filepath.Base(logPath), ".gz")
+		*prefix = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	if *title == "" {
+		*title = *prefix
+	}
+	recs, err := readLog(logPath)
+	if isError(err) {
+		return 1
+	}
+	seconds := perSecond(recs)
+	if len(seconds) == 0 {
+		fmt.Fprintf(os.Stderr, "Logger: no events in %s\n", logPath)
+		return 1
+	}
+	out := filepath.Join(*outDir, *prefix)
+	for _, err := range []error{
+		writeFile(out+"-delay.csv", delayCSV(seconds)),
+		writeFile(out+"-bandwidth.csv", bandwidthCSV(seconds)),
+		writeFile(out+"-time.svg", timeChart(seconds, *title)),
+		writeFile(out+"-bandwidth.svg", bandwidthChart(seconds, *title)),
+	} {
+		if isError(err) {
+			return 1
+		}
+	}
+	return 0
+}
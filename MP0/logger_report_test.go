@@ -0,0 +1,38 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPerSecond(t *testing.T) {
+	tests := []struct {
+		name        string
+		sent        []float64
+		wantSeconds int
+		wantCount   int
+	}{
+		{"none", nil, 0, 0},
+		{"one second", []float64{100.1, 100.5, 100.9}, 1, 3},
+		{"gap", []float64{100.5, 103.7}, 4, 2},
+		{"zero timestamp", []float64{0, 1e9, 1e9 + 1.5, 1e9 + 2}, 3, 3},
+		{"far future", []float64{1e9, 1e9 + 1, 1e9 + 2, 9e18}, 3, 3},
+		{"not a number", []float64{math.NaN(), 1e9, 1e9 + 1}, 2, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var recs []Record
+			for _, ts := range tt.sent {
+				recs = append(recs, Record{Type: "event", ClientTS: ts, CorDelay: 0.001, Bytes: 10})
+			}
+			seconds := perSecond(recs)
+			count := 0
+			for _, s := range seconds {
+				count += len(s.delays)
+			}
+			if len(seconds) != tt.wantSeconds || count != tt.wantCount {
+				t.Errorf("%d seconds with %d records, want %d with %d", len(seconds), count, tt.wantSeconds, tt.wantCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Log rotation, applied to log.txt and the stats file
+		-rotate-size		rotate once the file would grow past this many bytes
+		-rotate-interval	rotate once the file has been open this long
+		-retain				keep at most this many rotated files, 0 keeps all
+		-gzip				compress rotated files
+	A rotated file is renamed to [name]-[yyyymmdd-hhmmss.mmm][ext], e.g.
+	log-20200206-034514.299.txt(.gz), with -1, -2, ... after the time if
+	the file rotates again within the same millisecond. Existing files are appended to on
+	startup, never truncated. If a rotation fails, writing goes on in the
+	current file and the rotation is retried after rotateRetry. Rotated
+	files are cleaned up in the background; shutdown waits for that.
+*/
+
+const rotateRetry = 10 * time.Second
+
+const rotateTimeFormat = "20060102-150405.000"
+
+var rotateSize int64
+var rotateInterval time.Duration
+var retainFiles int
+var gzipRotated bool
+
+var cleanMtx sync.Mutex // one cleanup at a time
+var cleanWg sync.WaitGroup
+
+// rotatingFile : append-only file that rotates between writes
+type rotatingFile struct {
+	mtx       sync.Mutex
+	path      string
+	file      *os.File
+	size      int64
+	opened    time.Time
+	rotated   string    // name file was renamed to while no new file opened
+	retry     time.Time // no rotation before this after a failed one
+	rotations int
+}
+
+func openRotating(path string) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file = f
+	rf.size = info.Size()
+	rf.opened = time.Now()
+	return nil
+}
+
+// needRotate reports whether writing n more bytes calls for a new file
+func (rf *rotatingFile) needRotate(n int) bool {
+	if rf.size == 0 || time.Now().Before(rf.retry) {
+		return false
+	}
+	if rotateSize > 0 && rf.size+int64(n) > rotateSize {
+		return true
+	}
+	return rotateInterval > 0 && time.Since(rf.opened) >= rotateInterval
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// rotatedName returns a name for a file of stem and ext rotated at t that
+// no earlier rotated file has, compressed or not
+func rotatedName(stem string, ext string, t time.Time) string {
+	base := stem + "-" + t.Format(rotateTimeFormat)
+	name := base + ext
+	for n := 1; fileExists(name) || fileExists(name+".gz"); n++ {
+		name = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+	return name
+}
+
+// parseRotated returns the rotation time and counter of a rotated file of
+// stem and ext, ok false for any other name
+func parseRotated(name string, stem string, ext string) (t time.Time, n int, ok bool) {
+	stamp := strings.TrimPrefix(name, stem+"-")
+	stamp = strings.TrimSuffix(strings.TrimSuffix(stamp, ".gz"), ext)
+	if i := strings.LastIndexByte(stamp, '-'); i >= len(rotateTimeFormat) { // counter
+		count, err := strconv.Atoi(stamp[i+1:])
+		if err != nil || count < 1 {
+			return t, 0, false
+		}
+		stamp, n = stamp[:i], count
+	}
+	t, err := time.Parse(rotateTimeFormat, stamp)
+	return t, n, err == nil
+}
+
+// rotate renames the current file out of the way and opens a fresh one;
+// the current file is only closed once the fresh one is open
+func (rf *rotatingFile) rotate() error {
+	if rf.rotated == "" {
+		ext := filepath.Ext(rf.path)
+		stem := strings.TrimSuffix(rf.path, ext)
+		rotated := rotatedName(stem, ext, time.Now())
+		if err := os.Rename(rf.path, rotated); err != nil {
+			return err
+		}
+		rf.rotated = rotated
+	}
+	old := rf.file
+	if err := rf.open(); err != nil {
+		return err
+	}
+	old.Close()
+	rf.rotations++
+	cleanWg.Add(1)
+	go func(path string, rotated string) {
+		defer cleanWg.Done()
+		cleanRotated(path, rotated)
+	}(rf.path, rf.rotated)
+	rf.rotated = ""
+	return nil
+}
+
+func (rf *rotatingFile) WriteString(s string) (int, error) {
+	rf.mtx.Lock()
+	defer rf.mtx.Unlock()
+	if rf.needRotate(len(s)) {
+		if err := rf.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Logger: cannot rotate %s, retrying in %v: %v\n", rf.path, rotateRetry, err)
+			rf.retry = time.Now().Add(rotateRetry)
+		}
+	}
+	n, err := rf.file.WriteString(s)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) Sync() error {
+	rf.mtx.Lock()
+	defer rf.mtx.Unlock()
+	return rf.file.Sync()
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mtx.Lock()
+	defer rf.mtx.Unlock()
+	return rf.file.Close()
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(path)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// cleanRotated compresses a freshly rotated file and drops the oldest
+// rotated files of path beyond retainFiles
+func cleanRotated(path string, rotated string) {
+	cleanMtx.Lock()
+	defer cleanMtx.Unlock()
+	if gzipRotated {
+		if err := gzipFile(rotated); err != nil {
+			fmt.Fprintf(os.Stderr, "Logger: cannot gzip %s: %v\n", rotated, err)
+		}
+	}
+	if retainFiles <= 0 {
+		return
+	}
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	candidates, err := filepath.Glob(stem + "-*" + ext + "*")
+	if isError(err) {
+		return
+	}
+	// only names with a rotation time, oldest first
+	type rotatedFile struct {
+		name string
+		t    time.Time
+		n    int
+	}
+	var files []rotatedFile
+	for _, name := range candidates {
+		if t, n, ok := parseRotated(name, stem, ext); ok {
+			files = append(files, rotatedFile{name, t, n})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].t.Equal(files[j].t) {
+			return files[i].t.Before(files[j].t)
+		}
+		return files[i].n < files[j].n
+	})
+	var matches []string
+	for _, f := range files {
+		matches = append(matches, f.name)
+	}
+	for len(matches) > retainFiles {
+		if err := os.Remove(matches[0]); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Logger: cannot remove %s: %v\n", matches[0], err)
+		}
+		matches = matches[1:]
+	}
+}
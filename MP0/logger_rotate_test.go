@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCleanRotated(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  []string
+		retain int
+		want   []string
+	}{
+		{
+			name:   "keeps newest",
+			files:  []string{"log-20200206-034514.299.txt", "log-20200206-034515.000.txt", "log-20200207-000000.000.txt"},
+			retain: 2,
+			want:   []string{"log-20200206-034515.000.txt", "log-20200207-000000.000.txt"},
+		},
+		{
+			name:   "gzipped",
+			files:  []string{"log-20200206-034514.299.txt.gz", "log-20200206-034515.000.txt.gz"},
+			retain: 1,
+			want:   []string{"log-20200206-034515.000.txt.gz"},
+		},
+		{
+			name:   "unrelated names",
+			files:  []string{"log-old.txt", "log-backup.txt.gz", "log-20200206-034514.299.txt", "log-20200207-000000.000.txt"},
+			retain: 1,
+			want:   []string{"log-20200207-000000.000.txt", "log-backup.txt.gz", "log-old.txt"},
+		},
+		{
+			name:   "same millisecond",
+			files:  []string{"log-20200206-034514.299-2.txt", "log-20200206-034514.299.txt", "log-20200206-034514.299-1.txt.gz", "log-20200206-034514.299-x.txt"},
+			retain: 2,
+			want:   []string{"log-20200206-034514.299-1.txt.gz", "log-20200206-034514.299-2.txt", "log-20200206-034514.299-x.txt"},
+		},
+		{
+			name:   "retain all",
+			files:  []string{"log-20200206-034514.299.txt", "log-20200207-000000.000.txt"},
+			retain: 0,
+			want:   []string{"log-20200206-034514.299.txt", "log-20200207-000000.000.txt"},
+		},
+	}
+	defer func(n int, gz bool) { retainFiles, gzipRotated = n, gz }(retainFiles, gzipRotated)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), nil, 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			retainFiles, gzipRotated = tt.retain, false
+			cleanRotated(filepath.Join(dir, "log.txt"), filepath.Join(dir, tt.files[len(tt.files)-1]))
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+			sort.Strings(got)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("left %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRotatedName(t *testing.T) {
+	at := time.Date(2020, 2, 6, 3, 45, 14, 299e6, time.Local)
+	tests := []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{"first", nil, "log-20200206-034514.299.txt"},
+		{"taken", []string{"log-20200206-034514.299.txt"}, "log-20200206-034514.299-1.txt"},
+		{"gzipped", []string{"log-20200206-034514.299.txt.gz"}, "log-20200206-034514.299-1.txt"},
+		{"twice", []string{"log-20200206-034514.299.txt.gz", "log-20200206-034514.299-1.txt"}, "log-20200206-034514.299-2.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), nil, 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := rotatedName(filepath.Join(dir, "log"), ".txt", at); got != filepath.Join(dir, tt.want) {
+				t.Errorf("rotated to %s, want %s", filepath.Base(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestRotate(t *testing.T) {
+	defer func(size int64) { rotateSize = size }(rotateSize)
+	rotateSize = 10
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "log.txt")
+	rf, err := openRotating(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	for _, s := range []string{"12345678\n", "abcdefgh\n"} {
+		if _, err := rf.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cleanWg.Wait()
+	rotated, _ := filepath.Glob(filepath.Join(dir, "log-*.txt"))
+	if len(rotated) != 1 {
+		t.Fatalf("rotated files %v, want one", rotated)
+	}
+	if b, _ := os.ReadFile(rotated[0]); string(b) != "12345678\n" {
+		t.Errorf("rotated file holds %q", b)
+	}
+	if b, _ := os.ReadFile(logPath); string(b) != "abcdefgh\n" {
+		t.Errorf("fresh file holds %q", b)
+	}
+}
+
+// TestRotateBurst rotates on every write, many times per millisecond, and
+// checks that no rotated file overwrites another
+func TestRotateBurst(t *testing.T) {
+	defer func(size int64) { rotateSize = size }(rotateSize)
+	rotateSize = 10
+	dir := t.TempDir()
+	rf, err := openRotating(filepath.Join(dir, "log.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	for i := 0; i < 50; i++ {
+		if _, err := rf.WriteString(fmt.Sprintf("line %03d\n", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cleanWg.Wait()
+	names, _ := filepath.Glob(filepath.Join(dir, "log*.txt"))
+	lines := 0
+	for _, name := range names {
+		b, _ := os.ReadFile(name)
+		lines += strings.Count(string(b), "\n")
+	}
+	if len(names) != 50 || lines != 50 {
+		t.Errorf("%d files with %d lines, want 50 and 50", len(names), lines)
+	}
+}
+
+// TestRotateFailure keeps writing to the current file when it cannot be
+// renamed
+func TestRotateFailure(t *testing.T) {
+	defer func(size int64) { rotateSize = size }(rotateSize)
+	rotateSize = 10
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	rf, err := openRotating(filepath.Join(dir, "sub", "log.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	rf.WriteString("12345678\n")
+	// the rename in the next rotation fails
+	if err := os.RemoveAll(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := rf.WriteString("abcdefgh\n"); err != nil {
+			t.Fatalf("write %d after a failed rotation: %v", i, err)
+		}
+	}
+	if rf.size != 36 || !rf.retry.After(time.Now()) {
+		t.Errorf("size %d retry %v, want 36 bytes in the current file and a later retry", rf.size, rf.retry)
+	}
+}
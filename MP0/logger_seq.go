@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	Per-node sequence numbers
+		node -> logger: [timestamp] - [node name] connected epoch=[epoch] next=[seq]
+		node -> logger: [timestamp] [node name] [event] seq=[seq]
+		logger -> node: ACK [seq]
+	Every event is acked on its own once it is logged (or found to be a
+	duplicate). Nodes replay unacked events after a reconnect, so the logger
+	remembers the logged seqs of every node across connections and drops
+	anything it has already logged. epoch identifies one run of a node, a
+	restarted node starts a new sequence; next tells the logger which seqs
+	the node has generated so far. Events without seq are always logged.
+
+	Seqs that were generated but never logged are reported as missing ranges
+	when the logger shuts down.
+
+	The logged seqs survive a restart in [log file].seq, one line per
+	logged event, written right after its log entry
+		[node name] [epoch, - for none] [seq or lo-hi]
+	On startup it is read back, keeping the latest run of every node, and
+	rewritten as ranges, so an event logged but not acked before the
+	restart is dropped when the node replays it. It is rewritten the same
+	way whenever the log rotates, so it stays as small as the log.
+*/
+
+// seqRange : seqs lo to hi, both included
+type seqRange struct {
+	lo, hi int64
+}
+
+// nodeState : what the logger remembers of one run of a node
+type nodeState struct {
+	name       string
+	epoch      string
+	received   []seqRange // sorted, disjoint, not adjacent
+	generated  int64      // highest seq the node announced or sent
+	logged     int64
+	duplicates int64
+}
+
+var nodeStates = make(map[string]*nodeState) // key: node name
+var retiredStates []*nodeState               // earlier runs of restarted nodes
+var nodeStatesMtx sync.Mutex
+
+var seqFile *os.File
+
+// parseSeq returns the seq option of a message, 0 if it has none
+func parseSeq(opts map[string]string, key string) int64 {
+	seq, err := strconv.ParseInt(opts[key], 10, 64)
+	if err != nil || seq < 1 {
+		return 0
+	}
+	return seq
+}
+
+// contains reports whether seq was already received
+func (st *nodeState) contains(seq int64) bool {
+	i := sort.Search(len(st.received), func(i int) bool { return st.received[i].hi >= seq })
+	return i < len(st.received) && st.received[i].lo <= seq
+}
+
+// insert adds seq, merging it with its neighbouring ranges
+func (st *nodeState) insert(seq int64) {
+	i := sort.Search(len(st.received), func(i int) bool { return st.received[i].hi >= seq })
+	joinPrev := i > 0 && st.received[i-1].hi == seq-1
+	joinNext := i < len(st.received) && st.received[i].lo == seq+1
+	switch {
+	case joinPrev && joinNext:
+		st.received[i-1].hi = st.received[i].hi
+		st.received = append(st.received[:i], st.received[i+1:]...)
+	case joinPrev:
+		st.received[i-1].hi = seq
+	case joinNext:
+		st.received[i].lo = seq
+	default:
+		st.received = append(st.received, seqRange{})
+		copy(st.received[i+1:], st.received[i:])
+		st.received[i] = seqRange{seq, seq}
+	}
+}
+
+// missing returns the generated seqs that were never received
+func (st *nodeState) missing() []seqRange {
+	var gaps []seqRange
+	next := int64(1)
+	for _, r := range st.received {
+		if r.lo > next {
+			gaps = append(gaps, seqRange{next, r.lo - 1})
+		}
+		next = r.hi + 1
+	}
+	if st.generated >= next {
+		gaps = append(gaps, seqRange{next, st.generated})
+	}
+	return gaps
+}
+
+func (st *nodeState) lastReceived() int64 {
+	if len(st.received) == 0 {
+		return 0
+	}
+	return st.received[len(st.received)-1].hi
+}
+
+// getNodeState returns the state of the current run of node, starting a new
+// one when the epoch changes
+func getNodeState(node string, epoch string) *nodeState {
+	st, ok := nodeStates[node]
+	if ok && (epoch == "" || st.epoch == epoch) {
+		return st
+	}
+	if ok {
+		retiredStates = append(retiredStates, st)
+	}
+	st = &nodeState{name: node, epoch: epoch}
+	nodeStates[node] = st
+	return st
+}
+
+// registerNode records the epoch and next seq announced in a handshake
+func registerNode(node string, opts map[string]string) {
+	nodeStatesMtx.Lock()
+	st := getNodeState(node, opts["epoch"])
+	if next := parseSeq(opts, "next"); next-1 > st.generated {
+		st.generated = next - 1
+	}
+	nodeStatesMtx.Unlock()
+}
+
+// nodeEpoch returns the epoch of the current run of node, "" if unknown
+func nodeEpoch(node string) string {
+	nodeStatesMtx.Lock()
+	defer nodeStatesMtx.Unlock()
+	if st, ok := nodeStates[node]; ok {
+		return st.epoch
+	}
+	return ""
+}
+
+// isDuplicate reports whether seq of node was already logged, counting it
+// as a duplicate if so
+func isDuplicate(node string, seq int64) bool {
+	nodeStatesMtx.Lock()
+	defer nodeStatesMtx.Unlock()
+	st := getNodeState(node, "")
+	if !st.contains(seq) {
+		return false
+	}
+	st.duplicates++
+	return true
+}
+
+// acceptSeq reports whether an event with seq from node is new and should
+// be logged, and if so the line for the seq file; gaps are reported as
+// soon as they show up
+func acceptSeq(node string, seq int64) (bool, string) {
+	nodeStatesMtx.Lock()
+	defer nodeStatesMtx.Unlock()
+	st := getNodeState(node, "")
+	if st.contains(seq) {
+		st.duplicates++
+		return false, ""
+	}
+	if last := st.lastReceived(); seq > last+1 {
+		fmt.Fprintf(os.Stderr, "Logger: %s gap, seq %d-%d not received yet\n", node, last+1, seq-1)
+	}
+	st.insert(seq)
+	st.logged++
+	if seq > st.generated {
+		st.generated = seq
+	}
+	return true, fmt.Sprintf("%s %s %d\n", node, seqEpoch(st.epoch), seq)
+}
+
+func seqEpoch(epoch string) string {
+	if epoch == "" {
+		return "-"
+	}
+	return epoch
+}
+
+// parseRange reads "seq" or "lo-hi"
+func parseRange(s string) (seqRange, error) {
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i > 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	l, err1 := strconv.ParseInt(lo, 10, 64)
+	h, err2 := strconv.ParseInt(hi, 10, 64)
+	if err1 != nil || err2 != nil || l < 1 || h < l {
+		return seqRange{}, fmt.Errorf("bad seq range %q", s)
+	}
+	return seqRange{l, h}, nil
+}
+
+// readSeqs reads the logged seqs of the latest run of every node
+func readSeqs(seqPath string) (map[string]*nodeState, error) {
+	states := make(map[string]*nodeState)
+	f, err := os.Open(seqPath)
+	if os.IsNotExist(err) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			// a line cut short by a crash
+			fmt.Fprintf(os.Stderr, "Logger: %s:%d: skipping %q\n", seqPath, lineNum, scanner.Text())
+			continue
+		}
+		r, err := parseRange(fields[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Logger: %s:%d: %v\n", seqPath, lineNum, err)
+			continue
+		}
+		epoch := fields[1]
+		if epoch == "-" {
+			epoch = ""
+		}
+		st, ok := states[fields[0]]
+		if !ok || st.epoch != epoch {
+			st = &nodeState{name: fields[0], epoch: epoch}
+			states[fields[0]] = st
+		}
+		if last := st.lastReceived(); len(st.received) == 0 || r.lo > last+1 {
+			st.received = append(st.received, r)
+		} else if r.lo == last+1 {
+			st.received[len(st.received)-1].hi = r.hi
+		} else {
+			for seq := r.lo; seq <= r.hi; seq++ {
+				if !st.contains(seq) {
+					st.insert(seq)
+				}
+			}
+		}
+		if r.hi > st.generated {
+			st.generated = r.hi
+		}
+	}
+	return states, scanner.Err()
+}
+
+// writeSeqFile replaces seqPath by the ranges of states and opens it to be
+// appended to from now on
+func writeSeqFile(seqPath string, states map[string]*nodeState) error {
+	tmp, err := os.Create(seqPath + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, st := range states {
+		for _, r := range st.received {
+			fmt.Fprintf(w, "%s %s %d-%d\n", st.name, seqEpoch(st.epoch), r.lo, r.hi)
+		}
+	}
+	err = w.Flush()
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(seqPath+".tmp", seqPath)
+	}
+	if err != nil {
+		os.Remove(seqPath + ".tmp")
+		return err
+	}
+	f, err := os.OpenFile(seqPath, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if seqFile != nil {
+		seqFile.Close()
+	}
+	seqFile = f
+	return nil
+}
+
+// openSeqFile restores the seqs logged next to logPath before a restart
+// and compacts the seq file into ranges, to be appended to from now on
+func openSeqFile(logPath string) error {
+	seqPath := logPath + ".seq"
+	states, err := readSeqs(seqPath)
+	if err != nil {
+		return err
+	}
+	nodeStates = states
+	return writeSeqFile(seqPath, states)
+}
+
+// compactSeqFile rewrites the seq file into ranges; the writer calls it
+// whenever the log rotates. It reads the file, not nodeStates, which also
+// holds seqs still waiting in the write queue.
+func compactSeqFile() error {
+	states, err := readSeqs(seqFile.Name())
+	if err != nil {
+		return err
+	}
+	return writeSeqFile(seqFile.Name(), states)
+}
+
+func formatRanges(ranges []seqRange) string {
+	if len(ranges) == 0 {
+		return "none"
+	}
+	var s []string
+	for _, r := range ranges {
+		if r.lo == r.hi {
+			s = append(s, strconv.FormatInt(r.lo, 10))
+		} else {
+			s = append(s, fmt.Sprintf("%d-%d", r.lo, r.hi))
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+// reportMissing prints, for every run of every node, how many events were
+// logged and which seqs are missing
+func reportMissing() {
+	nodeStatesMtx.Lock()
+	defer nodeStatesMtx.Unlock()
+	states := append([]*nodeState{}, retiredStates...)
+	for _, st := range nodeStates {
+		states = append(states, st)
+	}
+	sort.SliceStable(states, func(i, j int) bool { return states[i].name < states[j].name })
+	for _, st := range states {
+		fmt.Printf("SEQ %s epoch=%s logged=%d duplicates=%d generated=%d missing=%s\n",
+			st.name, st.epoch, st.logged, st.duplicates, st.generated, formatRanges(st.missing()))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeqRanges(t *testing.T) {
+	tests := []struct {
+		name        string
+		seqs        []int64
+		generated   int64
+		wantRanges  string
+		wantMissing string
+	}{
+		{"none", nil, 0, "none", "none"},
+		{"in order", []int64{1, 2, 3}, 3, "1-3", "none"},
+		{"gap", []int64{1, 2, 5}, 5, "1-2,5", "3-4"},
+		{"fills gap", []int64{1, 3, 2}, 3, "1-3", "none"},
+		{"joins next", []int64{5, 4, 1}, 5, "1,4-5", "2-3"},
+		{"not sent yet", []int64{2}, 4, "2", "1,3-4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := &nodeState{generated: tt.generated}
+			for _, seq := range tt.seqs {
+				if st.contains(seq) {
+					t.Fatalf("seq %d received before it was inserted", seq)
+				}
+				st.insert(seq)
+				if !st.contains(seq) {
+					t.Fatalf("seq %d not received after it was inserted", seq)
+				}
+			}
+			if got := formatRanges(st.received); got != tt.wantRanges {
+				t.Errorf("received %s, want %s", got, tt.wantRanges)
+			}
+			if got := formatRanges(st.missing()); got != tt.wantMissing {
+				t.Errorf("missing %s, want %s", got, tt.wantMissing)
+			}
+		})
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    seqRange
+		wantErr bool
+	}{
+		{"7", seqRange{7, 7}, false},
+		{"3-9", seqRange{3, 9}, false},
+		{"9-3", seqRange{}, true},
+		{"0", seqRange{}, true},
+		{"-3", seqRange{}, true},
+		{"3-", seqRange{}, true},
+		{"x", seqRange{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRange(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseRange(%q) = %v, %v, want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestReadSeqs(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines string
+		want  map[string]string // node: epoch received
+	}{
+		{"appended", "node1 7 1\nnode1 7 2\nnode1 7 3-5\n", map[string]string{"node1": "7 1-5"}},
+		{"no epoch", "node1 - 1-2\nnode1 - 4\n", map[string]string{"node1": " 1-2,4"}},
+		{"out of order", "node1 7 5\nnode1 7 1-2\nnode1 7 4\n", map[string]string{"node1": "7 1-2,4-5"}},
+		{"overlap", "node1 7 1-3\nnode1 7 2-6\n", map[string]string{"node1": "7 1-6"}},
+		{"restarted node", "node1 7 1-9\nnode1 8 1\n", map[string]string{"node1": "8 1"}},
+		{"two nodes", "node1 7 1\nnode2 3 1-2\n", map[string]string{"node1": "7 1", "node2": "3 1-2"}},
+		{"cut short", "node1 7 1-2\nnode1 7\nnode1 7 x\nnode1 7 3\n", map[string]string{"node1": "7 1-3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seqPath := filepath.Join(t.TempDir(), "log.txt.seq")
+			if err := os.WriteFile(seqPath, []byte(tt.lines), 0666); err != nil {
+				t.Fatal(err)
+			}
+			states, err := readSeqs(seqPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(states) != len(tt.want) {
+				t.Fatalf("%d nodes loaded, want %d", len(states), len(tt.want))
+			}
+			for node, want := range tt.want {
+				st, ok := states[node]
+				if !ok {
+					t.Fatalf("%s not loaded", node)
+				}
+				if got := st.epoch + " " + formatRanges(st.received); got != want {
+					t.Errorf("%s: %q, want %q", node, got, want)
+				}
+			}
+		})
+	}
+}
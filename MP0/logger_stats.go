@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	Stats file (-stats), one entry per node per second plus one for the
+	whole cluster (node "*"), written once the second is over
+		text: [second] [node] [count] [min] [max] [median] [p90] [bandwidth]
+			  [lost] [loss rate] [reordered] [duplicates] [wire bandwidth]
+		json: StatsRecord
+	Lost to duplicates are only counted for UDP senders (see logger_udp.go).
+	Wire bandwidth is what was actually received, less than the bandwidth
+	when nodes compress their batches (see logger_frame.go).
+*/
+
+const clusterName = "*"
+
+// StatsRecord : delay and bandwidth aggregate of one node in one second
+type StatsRecord struct {
+	Second    int64   `json:"second"`
+	Node      string  `json:"node"`
+	Count     int     `json:"count"`
+	DelayMin  float64 `json:"delay_min"`
+	DelayMax  float64 `json:"delay_max"`
+	DelayMed  float64 `json:"delay_median"`
+	Delay90   float64 `json:"delay_p90"`
+	Bandwidth int     `json:"bandwidth"`
+	WireBW    int     `json:"wire_bandwidth"`
+
+	Lost       int     `json:"lost,omitempty"`
+	LossRate   float64 `json:"loss_rate,omitempty"`
+	Reordered  int     `json:"reordered,omitempty"`
+	Duplicates int     `json:"duplicates,omitempty"`
+}
+
+// window : samples collected for one node in one second
+type window struct {
+	delays []float64
+	bytes  int
+	wire   int
+
+	udp        bool
+	expected   int // seqs the sender moved past in this second
+	lost       int
+	reordered  int
+	duplicates int
+}
+
+var statsPath string
+var statsFile *rotatingFile
+var statsMtx sync.Mutex
+
+// statsWindows : second -> node -> samples
+var statsWindows = make(map[int64]map[string]*window)
+
+func getWindow(second int64, node string) *window {
+	nodes, ok := statsWindows[second]
+	if !ok {
+		nodes = make(map[string]*window)
+		statsWindows[second] = nodes
+	}
+	w, ok := nodes[node]
+	if !ok {
+		w = &window{}
+		nodes[node] = w
+	}
+	return w
+}
+
+func addSample(second int64, node string, delay float64, bytes int, wire int) {
+	w := getWindow(second, node)
+	w.delays = append(w.delays, delay)
+	w.bytes += bytes
+	w.wire += wire
+}
+
+// addStats puts the corrected delay of a record into the window of the
+// second it was received in
+func addStats(rec Record) {
+	if rec.Bytes == 0 {
+		return
+	}
+	second := int64(rec.ServerTS)
+	statsMtx.Lock()
+	addSample(second, rec.Node, rec.CorDelay, rec.Bytes, rec.WireBytes)
+	addSample(second, clusterName, rec.CorDelay, rec.Bytes, rec.WireBytes)
+	statsMtx.Unlock()
+}
+
+// percentile of sorted values, interpolated linearly like numpy.percentile
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(rank)
+	if lo+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lo] + (rank-float64(lo))*(sorted[lo+1]-sorted[lo])
+}
+
+func aggregate(second int64, node string, w *window) StatsRecord {
+	sort.Float64s(w.delays)
+	n := len(w.delays)
+	st := StatsRecord{
+		Second:     second,
+		Node:       node,
+		Count:      n,
+		DelayMed:   percentile(w.delays, 50),
+		Delay90:    percentile(w.delays, 90),
+		Bandwidth:  w.bytes,
+		WireBW:     w.wire,
+		Lost:       w.lost,
+		Reordered:  w.reordered,
+		Duplicates: w.duplicates,
+	}
+	if n > 0 {
+		st.DelayMin = w.delays[0]
+		st.DelayMax = w.delays[n-1]
+	}
+	if w.expected > 0 {
+		st.LossRate = float64(w.lost) / float64(w.expected)
+	}
+	return st
+}
+
+func writeStats(st StatsRecord, udp bool) {
+	if udp {
+		fmt.Printf("STATS %d %s count=%d min=%f max=%f median=%f p90=%f bandwidth=%d wire=%d lost=%d loss=%f reordered=%d duplicates=%d\n",
+			st.Second, st.Node, st.Count, st.DelayMin, st.DelayMax, st.DelayMed, st.Delay90, st.Bandwidth, st.WireBW,
+			st.Lost, st.LossRate, st.Reordered, st.Duplicates)
+	} else {
+		fmt.Printf("STATS %d %s count=%d min=%f max=%f median=%f p90=%f bandwidth=%d wire=%d\n",
+			st.Second, st.Node, st.Count, st.DelayMin, st.DelayMax, st.DelayMed, st.Delay90, st.Bandwidth, st.WireBW)
+	}
+	if statsFile == nil {
+		return
+	}
+	if logFormat == formatJSON {
+		b, err := json.Marshal(st)
+		if isError(err) {
+			return
+		}
+		statsFile.WriteString(string(b) + "\n")
+	} else {
+		statsFile.WriteString(fmt.Sprintf("%d %s %d %f %f %f %f %d %d %f %d %d %d\n",
+			st.Second, st.Node, st.Count, st.DelayMin, st.DelayMax, st.DelayMed, st.Delay90, st.Bandwidth,
+			st.Lost, st.LossRate, st.Reordered, st.Duplicates, st.WireBW))
+	}
+}
+
+// flushStats emits every window older than the current second, cluster first
+func flushStats(now int64) {
+	statsMtx.Lock()
+	var seconds []int64
+	for second := range statsWindows {
+		if second < now {
+			seconds = append(seconds, second)
+		}
+	}
+	sort.Slice(seconds, func(i, j int) bool { return seconds[i] < seconds[j] })
+	for _, second := range seconds {
+		nodes := statsWindows[second]
+		delete(statsWindows, second)
+		cluster := nodes[clusterName]
+		writeStats(aggregate(second, clusterName, cluster), cluster.udp)
+		var names []string
+		for node := range nodes {
+			if node != clusterName {
+				names = append(names, node)
+			}
+		}
+		sort.Strings(names)
+		for _, node := range names {
+			writeStats(aggregate(second, node, nodes[node]), nodes[node].udp)
+		}
+	}
+	statsMtx.Unlock()
+}
+
+func runStats() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for t := range ticker.C {
+		flushStats(t.Unix())
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	Live subscribers (-subscribe [port])
+		subscriber -> logger: SUBSCRIBE [node=pattern] [min_delay=seconds]
+		logger -> subscriber: OK
+		logger -> subscriber: [Record as json]	// one per logged record
+		logger -> subscriber: ERR [reason]		// bad request, then close
+	pattern is a shell pattern (filepath.Match) on the node name, default "*".
+	With min_delay only events whose corrected delay is at least min_delay
+	are sent. A subscriber that cannot keep up loses records instead of
+	slowing down the logger; the number lost is printed when it leaves.
+*/
+
+const subscriberBuffer int = 1024
+
+var subscribePort string
+
+// subscriber : one live consumer and its filter
+type subscriber struct {
+	addr     string
+	pattern  string
+	minDelay float64
+	ch       chan []byte
+	dropped  int64
+}
+
+var subscribers = make(map[*subscriber]bool)
+var subscribersMtx sync.Mutex
+
+func (sub *subscriber) match(rec Record) bool {
+	if ok, _ := filepath.Match(sub.pattern, rec.Node); !ok {
+		return false
+	}
+	return sub.minDelay <= 0 || (rec.Type == "event" && rec.CorDelay >= sub.minDelay)
+}
+
+// publish hands a record to every matching subscriber without blocking
+func publish(rec Record) {
+	subscribersMtx.Lock()
+	defer subscribersMtx.Unlock()
+	if len(subscribers) == 0 {
+		return
+	}
+	b, err := json.Marshal(rec)
+	if isError(err) {
+		return
+	}
+	b = append(b, '\n')
+	for sub := range subscribers {
+		if !sub.match(rec) {
+			continue
+		}
+		select {
+		case sub.ch <- b:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// parseSubscribe reads "SUBSCRIBE [node=pattern] [min_delay=seconds]"
+func parseSubscribe(dat string) (*subscriber, error) {
+	fields := strings.Fields(dat)
+	if len(fields) == 0 || fields[0] != "SUBSCRIBE" {
+		return nil, fmt.Errorf("expected SUBSCRIBE")
+	}
+	sub := &subscriber{pattern: "*", ch: make(chan []byte, subscriberBuffer)}
+	for key, val := range parseOptions(fields[1:]) {
+		switch key {
+		case "node":
+			if _, err := filepath.Match(val, ""); err != nil {
+				return nil, fmt.Errorf("bad node pattern %q", val)
+			}
+			sub.pattern = val
+		case "min_delay":
+			d, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad min_delay %q", val)
+			}
+			sub.minDelay = d
+		default:
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return sub, nil
+}
+
+func handleSubscriber(conn net.Conn) {
+	defer conn.Close()
+	dat, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	sub, err := parseSubscribe(dat)
+	if err != nil {
+		fmt.Fprintf(conn, "ERR %s\n", err)
+		return
+	}
+	sub.addr = conn.RemoteAddr().String()
+	if _, err := fmt.Fprintf(conn, "OK\n"); err != nil {
+		return
+	}
+	subscribersMtx.Lock()
+	subscribers[sub] = true
+	subscribersMtx.Unlock()
+	fmt.Printf("%f - subscriber %s node=%s min_delay=%f\n", getTime(), sub.addr, sub.pattern, sub.minDelay)
+
+	// the subscriber sends nothing more, a read returns when it leaves
+	gone := make(chan struct{})
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				close(gone)
+				return
+			}
+		}
+	}()
+loop:
+	for {
+		select {
+		case b := <-sub.ch:
+			if _, err := conn.Write(b); err != nil {
+				break loop
+			}
+		case <-gone:
+			break loop
+		}
+	}
+
+	subscribersMtx.Lock()
+	delete(subscribers, sub)
+	dropped := sub.dropped
+	subscribersMtx.Unlock()
+	fmt.Printf("%f - subscriber %s left, %d records dropped\n", getTime(), sub.addr, dropped)
+}
+
+// runSubscribe accepts subscribers on port
+func runSubscribe(port string) {
+	ln, e := net.Listen("tcp", ":"+port)
+	if isError(e) {
+		return
+	}
+	for {
+		conn, err := ln.Accept()
+		if isError(err) {
+			continue
+		}
+		go handleSubscriber(conn)
+	}
+}
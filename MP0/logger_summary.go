@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+	Run summary (-summary), written when the logger shuts down
+		text:
+			run [start] [end] [duration]
+			node [name] events=[n] bytes=[n] wire=[n] throttled=[n] dropped=[n] delay min=.. p50=.. p90=.. p99=.. max=..
+				connected [time] disconnected [time]	// one line per connection
+		json: Summary
+	Delays are corrected delays of events, node "*" is the whole cluster.
+	throttled and dropped count events over the rate limit (see
+	logger_limit.go).
+*/
+
+var summaryPath string
+
+// Connection : connect and disconnect time of one node connection,
+// Disconnect is 0 while it is open
+type Connection struct {
+	ConnID     int64   `json:"conn_id"`
+	Connect    float64 `json:"connect"`
+	Disconnect float64 `json:"disconnect"`
+}
+
+// NodeSummary : totals of one node over the run
+type NodeSummary struct {
+	Node        string       `json:"node"`
+	Events      int          `json:"events"`
+	Bytes       int64        `json:"bytes"`
+	WireBytes   int64        `json:"wire_bytes"`
+	Throttled   int64        `json:"throttled"`
+	Dropped     int64        `json:"dropped"`
+	DelayMin    float64      `json:"delay_min"`
+	Delay50     float64      `json:"delay_p50"`
+	Delay90     float64      `json:"delay_p90"`
+	Delay99     float64      `json:"delay_p99"`
+	DelayMax    float64      `json:"delay_max"`
+	Connections []Connection `json:"connections,omitempty"`
+	delays      []float64
+}
+
+// Summary : the whole run
+type Summary struct {
+	Start    float64        `json:"start"`
+	End      float64        `json:"end"`
+	Duration float64        `json:"duration"`
+	Nodes    []*NodeSummary `json:"nodes"`
+}
+
+var summaryMtx sync.Mutex
+var runStart = getTime()
+var nodeSummaries = make(map[string]*NodeSummary)
+
+func getNodeSummary(node string) *NodeSummary {
+	ns, ok := nodeSummaries[node]
+	if !ok {
+		ns = &NodeSummary{Node: node}
+		nodeSummaries[node] = ns
+	}
+	return ns
+}
+
+// summarize adds one logged record to the run summary
+func summarize(rec Record) {
+	summaryMtx.Lock()
+	defer summaryMtx.Unlock()
+	ns := getNodeSummary(rec.Node)
+	switch rec.Type {
+	case "connected":
+		ns.Connections = append(ns.Connections, Connection{ConnID: rec.ConnID, Connect: rec.ServerTS})
+	case "disconnected":
+		for i := range ns.Connections {
+			if ns.Connections[i].ConnID == rec.ConnID {
+				ns.Connections[i].Disconnect = rec.ServerTS
+			}
+		}
+		return
+	}
+	cluster := getNodeSummary(clusterName)
+	for _, s := range []*NodeSummary{ns, cluster} {
+		s.Bytes += int64(rec.Bytes)
+		s.WireBytes += int64(rec.WireBytes)
+		if rec.Type == "event" {
+			s.Events++
+			s.delays = append(s.delays, rec.CorDelay)
+		}
+	}
+}
+
+// buildSummary computes the delay percentiles, cluster first
+func buildSummary(end float64) Summary {
+	summaryMtx.Lock()
+	defer summaryMtx.Unlock()
+	sum := Summary{Start: runStart, End: end, Duration: end - runStart}
+	getNodeSummary(clusterName)
+	for _, ns := range nodeSummaries {
+		sort.Float64s(ns.delays)
+		ns.Throttled, ns.Dropped = limitCounts(ns.Node)
+		if n := len(ns.delays); n > 0 {
+			ns.DelayMin = ns.delays[0]
+			ns.Delay50 = percentile(ns.delays, 50)
+			ns.Delay90 = percentile(ns.delays, 90)
+			ns.Delay99 = percentile(ns.delays, 99)
+			ns.DelayMax = ns.delays[n-1]
+		}
+		sum.Nodes = append(sum.Nodes, ns)
+	}
+	sort.Slice(sum.Nodes, func(i, j int) bool {
+		if sum.Nodes[i].Node == clusterName || sum.Nodes[j].Node == clusterName {
+			return sum.Nodes[i].Node == clusterName
+		}
+		return sum.Nodes[i].Node < sum.Nodes[j].Node
+	})
+	return sum
+}
+
+func formatSummary(sum Summary) string {
+	if logFormat == formatJSON {
+		b, err := json.Marshal(sum)
+		if isError(err) {
+			return ""
+		}
+		return string(b) + "\n"
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "run %f %f %f\n", sum.Start, sum.End, sum.Duration)
+	for _, ns := range sum.Nodes {
+		fmt.Fprintf(&sb, "node %s events=%d bytes=%d wire=%d throttled=%d dropped=%d delay min=%f p50=%f p90=%f p99=%f max=%f\n",
+			ns.Node, ns.Events, ns.Bytes, ns.WireBytes, ns.Throttled, ns.Dropped, ns.DelayMin, ns.Delay50, ns.Delay90, ns.Delay99, ns.DelayMax)
+		for _, c := range ns.Connections {
+			fmt.Fprintf(&sb, "\tconnected %f disconnected %f\n", c.Connect, c.Disconnect)
+		}
+	}
+	return sb.String()
+}
+
+// writeSummary prints the run summary and appends it to summaryPath
+func writeSummary() {
+	out := formatSummary(buildSummary(getTime()))
+	fmt.Print(out)
+	if summaryPath == "" {
+		return
+	}
+	f, err := os.OpenFile(summaryPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if isError(err) {
+		return
+	}
+	defer f.Close()
+	f.WriteString(out)
+	f.Sync()
+}
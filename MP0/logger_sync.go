@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Clock offset estimation (NTP style), started by the logger on connect
+	and repeated every -sync interval
+		logger -> node: SYNC [id] [t1]
+		node -> logger: SYNC [id] [t1] [t2] [t3]
+	t1: logger send time, t2: node receive time, t3: node reply time,
+	t4: logger receive time
+		offset = ((t2 - t1) + (t3 - t4)) / 2	(node clock - logger clock)
+		rtt    = (t4 - t1) - (t3 - t2)
+	The offset of the sample with the smallest rtt among the last
+	maxSyncSamples is used to correct delays.
+
+	Heartbeats, sent by nodes to detect a dead logger (see node.go)
+		node -> logger: PING [t]
+		logger -> node: PONG [t]
+*/
+
+const maxSyncSamples int = 8
+
+var syncInterval time.Duration
+
+// syncSample : result of one offset exchange
+type syncSample struct {
+	offset float64
+	rtt    float64
+}
+
+func sendSync(nc *nodeConn, id int) {
+	nc.writeLine(fmt.Sprintf("SYNC %d %f\n", id, getTime()))
+}
+
+// runSync probes the node on connect and every interval until done
+func runSync(nc *nodeConn, interval time.Duration) {
+	id := 0
+	sendSync(nc, id)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-nc.done:
+			return
+		case <-ticker.C:
+			id++
+			sendSync(nc, id)
+		}
+	}
+}
+
+// handleSyncReply parses "SYNC [id] [t1] [t2] [t3]" received at t4
+func handleSyncReply(nc *nodeConn, dat string, t4 float64) error {
+	fields := strings.Fields(dat)
+	if len(fields) != 5 {
+		return fmt.Errorf("Logger: malformed sync reply %q", dat)
+	}
+	var t [3]float64
+	for i := range t {
+		v, err := strconv.ParseFloat(fields[i+2], 64)
+		if err != nil {
+			return fmt.Errorf("Logger: bad timestamp in sync reply %q", dat)
+		}
+		t[i] = v
+	}
+	t1, t2, t3 := t[0], t[1], t[2]
+	sample := syncSample{
+		offset: ((t2 - t1) + (t3 - t4)) / 2,
+		rtt:    (t4 - t1) - (t3 - t2),
+	}
+
+	nc.syncMtx.Lock()
+	nc.samples = append(nc.samples, sample)
+	if len(nc.samples) > maxSyncSamples {
+		nc.samples = nc.samples[1:]
+	}
+	best := nc.samples[0]
+	for _, s := range nc.samples {
+		if s.rtt < best.rtt {
+			best = s
+		}
+	}
+	nc.offset = best.offset
+	nc.syncMtx.Unlock()
+
+	fmt.Printf("SYNC %s offset=%f rtt=%f\n", nc.name, sample.offset, sample.rtt)
+	return nil
+}
+
+// getOffset returns the current node clock offset, 0 before the first sync
+func (nc *nodeConn) getOffset() float64 {
+	nc.syncMtx.Lock()
+	defer nc.syncMtx.Unlock()
+	return nc.offset
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+	Loopback harness: the logger runs in this process on an ephemeral
+	localhost port and simulated nodes speak the wire protocol to it
+		go test logger.go logger_*.go	(or make test)
+*/
+
+// simNode : one simulated node
+type simNode struct {
+	name   string
+	events int     // events to send
+	rate   float64 // events per second
+	batch  int     // events per compressed frame, 0 sends plain lines
+}
+
+// startLogger resets the logger state and serves on an ephemeral port
+func startLogger(t *testing.T, format string) net.Listener {
+	t.Helper()
+	return startLoggerAt(t, format, filepath.Join(t.TempDir(), "log.txt"))
+}
+
+// resetLogger puts every setting and piece of state back to what a fresh
+// logger started without options has
+func resetLogger(format string, logPath string) {
+	path, logFormat = logPath, format
+	statsPath, statsFile, summaryPath = "", nil, ""
+	causalPath, concurrentPath = "", ""
+	syncInterval, drainTimeout = 0, time.Second
+	rotateSize, rotateInterval, retainFiles, gzipRotated = 0, 0, 0, false
+	udpEnabled, udpConn = false, nil
+	udpPeers, udpRuns = make(map[string]*nodeConn), make(map[string]udpRun)
+	tlsServerConfig, tlsClientConfig = nil, nil
+	trustedNames = make(map[string]bool)
+	targets, peerIPs, relayIPs, relayStopping = nil, make(map[string]bool), make(map[string]bool), false
+	rateLimit, burst = 0, 10
+	buckets = make(map[string]*bucket)
+	shuttingDown = false
+	openConns = make(map[net.Conn]bool)
+	nodeStates, retiredStates = make(map[string]*nodeState), nil
+	nodeSummaries = make(map[string]*NodeSummary)
+	metrics, connectedNodes = make(map[string]*nodeMetrics), 0
+	statsWindows = make(map[int64]map[string]*window)
+	loggerLamport, mergedVC, clockedRecords = 0, make(map[string]int64), nil
+}
+
+// startLoggerAt starts a logger appending to logPath, as after a restart;
+// its listener, writer and files are stopped and closed when the test ends
+func startLoggerAt(t *testing.T, format string, logPath string) net.Listener {
+	t.Helper()
+	resetLogger(format, logPath)
+
+	var err error
+	file, err = openRotating(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	if err := openSeqFile(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { seqFile.Close() })
+	writeQueue = make(chan writeReq, 100)
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		runWriter(stop)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-stopped
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepting := make(chan struct{})
+	go func() {
+		acceptConns(ln)
+		close(accepting)
+	}()
+	t.Cleanup(func() {
+		connsMtx.Lock()
+		shuttingDown = true
+		connsMtx.Unlock()
+		ln.Close()
+		<-accepting
+	})
+	return ln
+}
+
+func eventLine(n simNode, seq int) string {
+	ts := float64(time.Now().UnixNano()) / float64(time.Second)
+	return fmt.Sprintf("%f %s %s-%d seq=%d lc=%d\n", ts, n.name, n.name, seq, seq, seq)
+}
+
+func compressFrame(lines []string) []byte {
+	var data bytes.Buffer
+	w, _ := flate.NewWriter(&data, flate.DefaultCompression)
+	w.Write([]byte(strings.Join(lines, "")))
+	w.Close()
+	return append([]byte(fmt.Sprintf("Z %d %d\n", len(lines), data.Len())), data.Bytes()...)
+}
+
+// run sends the events of n at its rate and returns once all are acked
+func (n simNode) run(t *testing.T, addr string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	var writeMtx sync.Mutex
+	write := func(b []byte) {
+		writeMtx.Lock()
+		defer writeMtx.Unlock()
+		if _, err := conn.Write(b); err != nil {
+			t.Error(err)
+		}
+	}
+	write([]byte(fmt.Sprintf("%f - %s connected epoch=1 next=1\n", float64(time.Now().UnixNano())/float64(time.Second), n.name)))
+
+	acked := make(chan struct{})
+	go func() {
+		reader := bufio.NewReader(conn)
+		count := 0
+		for count < n.events {
+			dat, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(dat)
+			switch {
+			case len(fields) == 3 && fields[0] == "SYNC":
+				now := float64(time.Now().UnixNano()) / float64(time.Second)
+				write([]byte(fmt.Sprintf("SYNC %s %s %f %f\n", fields[1], fields[2], now, now)))
+			case len(fields) >= 2 && fields[0] == "ACK":
+				count++
+			}
+		}
+		close(acked)
+	}()
+
+	var frame []string
+	for seq := 1; seq <= n.events; seq++ {
+		line := eventLine(n, seq)
+		if n.batch == 0 {
+			write([]byte(line))
+		} else if frame = append(frame, line); len(frame) == n.batch || seq == n.events {
+			write(compressFrame(frame))
+			frame = nil
+		}
+		time.Sleep(time.Duration(float64(time.Second) / n.rate))
+	}
+	select {
+	case <-acked:
+	case <-time.After(10 * time.Second):
+		t.Errorf("%s: not every event was acked", n.name)
+	}
+}
+
+// runNodes runs the nodes concurrently, then shuts the logger down
+func runNodes(t *testing.T, ln net.Listener, nodes []simNode) {
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		wg.Add(1)
+		go func(n simNode) {
+			defer wg.Done()
+			n.run(t, ln.Addr().String())
+		}(n)
+	}
+	wg.Wait()
+	shutdown(ln)
+}
+
+var testNodes = []simNode{
+	{name: "node1", events: 50, rate: 200},
+	{name: "node2", events: 50, rate: 100},
+	{name: "node3", events: 30, rate: 50},
+	{name: "node4", events: 40, rate: 200, batch: 8},
+}
+
+// checkEvent checks that msg belongs to node and follows its previous event
+func checkEvent(t *testing.T, last map[string]int, node string, msg string) {
+	t.Helper()
+	i := strings.LastIndexByte(msg, '-')
+	if i < 0 || msg[:i] != node {
+		t.Errorf("event %q logged for %s", msg, node)
+		return
+	}
+	seq, _ := strconv.Atoi(msg[i+1:])
+	if seq != last[node]+1 {
+		t.Errorf("%s: event %d logged after %d", node, seq, last[node])
+	}
+	last[node] = seq
+}
+
+func checkCounts(t *testing.T, last map[string]int, connected map[string]int) {
+	t.Helper()
+	for _, n := range testNodes {
+		if last[n.name] != n.events {
+			t.Errorf("%s: %d events logged, want %d", n.name, last[n.name], n.events)
+		}
+		if connected[n.name] != 1 {
+			t.Errorf("%s: %d connects logged, want 1", n.name, connected[n.name])
+		}
+	}
+}
+
+func TestTextLog(t *testing.T) {
+	ln := startLogger(t, formatText)
+	runNodes(t, ln, testNodes)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	last := make(map[string]int)
+	connected := make(map[string]int)
+	for entry := 0; scanner.Scan(); entry++ {
+		logLine := scanner.Text()
+		if !scanner.Scan() {
+			t.Fatalf("entry %d %q: no delay line", entry, logLine)
+		}
+		delays := strings.Fields(scanner.Text())
+		if !scanner.Scan() {
+			t.Fatalf("entry %d %q: no length line", entry, logLine)
+		}
+		lengths := strings.Fields(scanner.Text())
+
+		if len(delays) != 2 {
+			t.Fatalf("entry %d %q: delay line %q", entry, logLine, delays)
+		}
+		for _, d := range delays {
+			if v, err := strconv.ParseFloat(d, 64); err != nil || v < -1 || v > 10 {
+				t.Errorf("entry %d %q: bad delay %q", entry, logLine, d)
+			}
+		}
+		if len(lengths) != 2 {
+			t.Fatalf("entry %d %q: length line %q", entry, logLine, lengths)
+		}
+		size, err1 := strconv.Atoi(lengths[0])
+		wire, err2 := strconv.Atoi(lengths[1])
+		if err1 != nil || err2 != nil || size <= 0 || wire <= 0 {
+			t.Errorf("entry %d %q: bad lengths %q", entry, logLine, lengths)
+		}
+
+		fields := strings.Fields(logLine)
+		if _, err := strconv.ParseFloat(fields[0], 64); err != nil {
+			t.Errorf("entry %d %q: bad timestamp", entry, logLine)
+		}
+		switch {
+		case len(fields) == 4 && fields[1] == "-" && fields[3] == "connected":
+			connected[fields[2]]++
+		case len(fields) == 3:
+			checkEvent(t, last, fields[1], fields[2])
+		default:
+			t.Errorf("entry %d: malformed %q", entry, logLine)
+		}
+	}
+	checkCounts(t, last, connected)
+}
+
+func TestJSONLog(t *testing.T) {
+	ln := startLogger(t, formatJSON)
+	runNodes(t, ln, testNodes)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	last := make(map[string]int)
+	connected := make(map[string]int)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("malformed record %q: %v", scanner.Text(), err)
+		}
+		switch rec.Type {
+		case "connected":
+			connected[rec.Node]++
+		case "event":
+			checkEvent(t, last, rec.Node, rec.Msg)
+			if rec.Seq != int64(last[rec.Node]) {
+				t.Errorf("%s: event %q has seq %d", rec.Node, rec.Msg, rec.Seq)
+			}
+			if rec.Bytes <= 0 || rec.WireBytes <= 0 || rec.ServerTS < rec.ClientTS-1 || rec.Delay != rec.ServerTS-rec.ClientTS {
+				t.Errorf("inconsistent record %q", scanner.Text())
+			}
+		case "disconnected":
+		default:
+			t.Errorf("unexpected record %q", scanner.Text())
+		}
+	}
+	checkCounts(t, last, connected)
+}
+
+// sendRun connects as node with epoch, sends the events with seqs from to
+// last and returns once the logger acked all of them
+func sendRun(t *testing.T, addr string, epoch int, from int, last int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "%f - node1 connected epoch=%d next=%d\n", float64(time.Now().UnixNano())/float64(time.Second), epoch, last+1)
+	for seq := from; seq <= last; seq++ {
+		conn.Write([]byte(eventLine(simNode{name: "node1"}, seq)))
+	}
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for acked := 0; acked < last-from+1; {
+		dat, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%d of %d events acked: %v", acked, last-from+1, err)
+		}
+		if strings.HasPrefix(dat, "ACK ") {
+			acked++
+		}
+	}
+}
+
+// TestRestartBeforeAck restarts the logger after it logged events whose
+// acks the node never saw, then lets the node replay them
+func TestRestartBeforeAck(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "log.txt")
+	ln := startLoggerAt(t, formatJSON, logPath)
+	sendRun(t, ln.Addr().String(), 7, 1, 3) // the acks are lost with the logger
+	shutdown(ln)
+
+	ln = startLoggerAt(t, formatJSON, logPath)
+	sendRun(t, ln.Addr().String(), 7, 1, 5) // replays 1-3
+	shutdown(ln)
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	last := make(map[string]int)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("malformed record %q: %v", scanner.Text(), err)
+		}
+		if rec.Type == "event" {
+			checkEvent(t, last, rec.Node, rec.Msg)
+		}
+	}
+	if last["node1"] != 5 {
+		t.Errorf("%d events logged, want 5", last["node1"])
+	}
+	if nodeStates["node1"].duplicates != 3 {
+		t.Errorf("%d duplicates dropped, want 3", nodeStates["node1"].duplicates)
+	}
+}
+
+// TestReplayNotLimited replays logged events to a node that has no tokens
+// left; the replays must be acked without waiting for one
+func TestReplayNotLimited(t *testing.T) {
+	ln := startLogger(t, formatJSON)
+	defer shutdown(ln)
+	rateLimit, burst = 0.001, 2
+	var acks bytes.Buffer
+	nc := &nodeConn{name: "node1", conn: &acks, done: make(chan struct{})}
+	for i, seq := range []int{1, 2, 1, 2, 1} {
+		_, isNew, err := handleEvent(nc, eventLine(simNode{name: "node1"}, seq), getTime(), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isNew != (i < 2) {
+			t.Errorf("event %d seq %d: logged=%v", i, seq, isNew)
+		}
+	}
+	if n := strings.Count(acks.String(), "ACK "); n != 5 {
+		t.Errorf("%d acks, want 5", n)
+	}
+	if b := buckets["node1"]; b.tokens >= 1 || b.throttled != 0 {
+		t.Errorf("%.3f tokens left, %d throttled, want 0 and 0", b.tokens, b.throttled)
+	}
+}
+
+// TestSeqFileRotation rotates the log every few events and checks that the
+// seq file is compacted along with it and still covers every event
+func TestSeqFileRotation(t *testing.T) {
+	ln := startLogger(t, formatText)
+	rotateSize = 300
+	flushWrites() // the writer sees rotateSize from now on
+	sendRun(t, ln.Addr().String(), 7, 1, 50)
+	shutdown(ln)
+
+	b, err := os.ReadFile(path + ".seq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "\n"); n > 10 {
+		t.Errorf("seq file has %d lines for 50 events, not compacted", n)
+	}
+	states, err := readSeqs(path + ".seq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := states["node1"]; st == nil || formatRanges(st.received) != "1-50" {
+		t.Errorf("seq file holds %q, want node1 1-50", b)
+	}
+}
+
+// lineWriter : a node connection that hands every line to the test
+type lineWriter chan string
+
+func (w lineWriter) Write(b []byte) (int, error) {
+	w <- string(b)
+	return len(b), nil
+}
+
+// TestAckAfterWrite holds the writer back and checks that the node is only
+// acked once its event is written
+func TestAckAfterWrite(t *testing.T) {
+	startLogger(t, formatText)
+	flushWrites() // the writer runs on the old queue from now on
+	writeQueue = make(chan writeReq, 10)
+	acks := make(lineWriter, 1)
+	nc := &nodeConn{name: "node1", conn: acks, done: make(chan struct{})}
+	go handleEvent(nc, eventLine(simNode{name: "node1"}, 1), getTime(), 10)
+
+	req := <-writeQueue
+	select {
+	case ack := <-acks:
+		t.Fatalf("acked %q before the event was written", ack)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(req.done)
+	select {
+	case ack := <-acks:
+		if !strings.HasPrefix(ack, "ACK 1 ") {
+			t.Errorf("got %q, want ACK 1", ack)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("never acked after the write")
+	}
+}
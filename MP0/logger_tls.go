@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+	Authenticated connections (-tls-cert, -tls-key, -tls-ca)
+		With -tls-cert, -tls-key and -tls-ca node connections are TLS, every
+		node must present a certificate signed by that CA, and the node name
+		in its handshake must be the certificate's common name; only the
+		names in -trust (relays and peers) may speak for others.
+		Anything else is rejected: the connection is closed, a line is
+		printed to stderr and an entry is written to the log
+			[server timestamp] - [claimed name or address] rejected
+			0.000000 0.000000
+			0 0
+		or in json
+			{"type":"rejected","node":[claimed name or address],"server_ts":...,"conn_id":...,"msg":[reason]}
+		Forwarding to a parent or peers is over TLS too, with the same
+		certificate, so it needs the client auth key usage as well, and
+		their certificates are checked against the same CA.
+	UDP cannot be authenticated, so -udp is refused together with TLS.
+*/
+
+const handshakeTimeout = 5 * time.Second
+
+var tlsCertPath, tlsKeyPath, tlsCAPath string
+var trustList string
+var trustedNames = make(map[string]bool)
+var tlsServerConfig *tls.Config
+var tlsClientConfig *tls.Config // for forwarding
+
+// setupTLS loads the certificates given on the command line
+func setupTLS() error {
+	if tlsCertPath == "" && tlsKeyPath == "" && tlsCAPath == "" {
+		return nil
+	}
+	if tlsCertPath == "" || tlsKeyPath == "" {
+		return fmt.Errorf("Logger: -tls-cert and -tls-key go together")
+	}
+	if tlsCAPath == "" {
+		return fmt.Errorf("Logger: -tls-cert needs -tls-ca to check nodes and other loggers")
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCertPath, tlsKeyPath)
+	if err != nil {
+		return err
+	}
+	tlsServerConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	tlsClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	pem, err := os.ReadFile(tlsCAPath)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("Logger: no certificate in %s", tlsCAPath)
+	}
+	tlsServerConfig.ClientCAs = pool
+	tlsServerConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsClientConfig.RootCAs = pool
+	for _, name := range strings.Split(trustList, ",") {
+		if name != "" {
+			trustedNames[name] = true
+		}
+	}
+	return nil
+}
+
+// authenticate completes the TLS handshake of conn and returns the common
+// name of the node certificate, "" without client certificates
+func authenticate(conn net.Conn) (string, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	tc.SetDeadline(time.Now().Add(handshakeTimeout))
+	err := tc.Handshake()
+	tc.SetDeadline(time.Time{})
+	if err != nil {
+		return "", err
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", nil
+	}
+	return certs[0].Subject.CommonName, nil
+}
+
+// authorized reports whether the node authenticated as identity may send
+// events as name
+func authorized(identity string, name string) bool {
+	return tlsServerConfig == nil || identity == name || trustedNames[identity]
+}
+
+// reject logs a refused connection; the caller closes it
+func reject(conn net.Conn, connID int64, name string, reason string) {
+	ts := getTime()
+	fmt.Fprintf(os.Stderr, "Logger: rejected %s (%s): %s\n", conn.RemoteAddr(), name, reason)
+	if name == "" {
+		name = conn.RemoteAddr().String() // handshake failed
+	}
+	rec := Record{Type: "rejected", Node: name, ServerTS: ts, ConnID: connID, Msg: reason}
+	writeRecord(rec, fmt.Sprintf("%f - %s rejected\n", ts, name))
+}
+
+// dialTLS connects to another logger, over TLS if configured
+func dialTLS(addr string) (net.Conn, error) {
+	if tlsClientConfig == nil {
+		return net.Dial("tcp", addr)
+	}
+	return tls.Dial("tcp", addr, tlsClientConfig)
+}
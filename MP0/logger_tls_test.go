@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReject(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	addr := client.RemoteAddr().String()
+
+	tests := []struct {
+		format string
+		name   string
+		want   string
+	}{
+		{formatText, "node1", "node1"},
+		{formatText, "", addr},
+		{formatJSON, "node1", "node1"},
+		{formatJSON, "", addr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format+" "+tt.want, func(t *testing.T) {
+			startLogger(t, tt.format)
+			reject(client, 1, tt.name, "handshake failed")
+			flushWrites()
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			node := ""
+			if tt.format == formatJSON {
+				var rec Record
+				if err := json.Unmarshal(b, &rec); err != nil || rec.Type != "rejected" {
+					t.Fatalf("bad record %q: %v", b, err)
+				}
+				node = rec.Node
+			} else if fields := strings.Fields(string(b)); len(fields) == 8 && fields[3] == "rejected" {
+				node = fields[2]
+			} else {
+				t.Fatalf("bad entry %q", b)
+			}
+			if node != tt.want {
+				t.Errorf("rejected %q, want %q", node, tt.want)
+			}
+		})
+	}
+}
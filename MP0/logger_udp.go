@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	UDP transport (-udp), on the same port number as TCP
+		node -> logger: the same lines as over TCP, a batch of lines or one
+						compressed frame per datagram
+		logger -> node: SYNC, ACK and PONG datagrams back to the sender's address
+	A sender is known by its address and node name. There is no replay, so
+	every second the stats also count, per UDP sender
+		lost		seqs skipped over in this second
+		loss rate	lost / seqs the sender moved past in this second
+		reordered	seqs older than the newest one seen, e.g. skipped earlier
+		duplicates	seqs already logged
+	A seq counted as lost that shows up later is counted as reordered then;
+	the exact missing ranges are in the SEQ report on shutdown.
+	A sender that sent nothing for udpIdleTimeout is forgotten, e.g. a
+	restarted node that now sends from another port.
+*/
+
+const udpIdleTimeout = time.Minute
+
+var udpEnabled bool
+var udpConn net.PacketConn
+
+// udpPeer : sends datagrams back to one sender
+type udpPeer struct {
+	pc       net.PacketConn
+	addr     net.Addr
+	lastSeen time.Time
+}
+
+func (p *udpPeer) Write(b []byte) (int, error) {
+	return p.pc.WriteTo(b, p.addr)
+}
+
+var udpPeers = make(map[string]*nodeConn) // key: sender address, only used by runUDP
+var udpRuns = make(map[string]udpRun)     // key: node name, protected by statsMtx
+var udpLastSweep time.Time
+
+// newUDPPeer starts a sender named name at addr, replacing a known one
+func newUDPPeer(pc net.PacketConn, addr net.Addr, name string) *nodeConn {
+	if nc, known := udpPeers[addr.String()]; known {
+		close(nc.done)
+	}
+	nc := &nodeConn{id: atomic.AddInt64(&nextConnID, 1), name: name, conn: &udpPeer{pc, addr, time.Now()}, done: make(chan struct{})}
+	udpPeers[addr.String()] = nc
+	return nc
+}
+
+// evictIdle forgets the senders idle since before now-timeout
+func evictIdle(now time.Time, timeout time.Duration) {
+	for addr, nc := range udpPeers {
+		if now.Sub(nc.conn.(*udpPeer).lastSeen) > timeout {
+			close(nc.done)
+			delete(udpPeers, addr)
+		}
+	}
+	udpLastSweep = now
+}
+
+// udpRun : the latest run of a UDP sender and the highest seq it sent
+type udpRun struct {
+	epoch  string
+	maxSeq int64
+}
+
+// addUDPStats counts loss, reordering and duplicates of one datagram of the
+// run epoch of node; a new run starts again from seq 1
+func addUDPStats(node string, epoch string, seq int64, serverTS float64, duplicate bool) {
+	second := int64(serverTS)
+	statsMtx.Lock()
+	defer statsMtx.Unlock()
+	var expected, lost, reordered, duplicates int
+	run := udpRuns[node]
+	if run.epoch != epoch {
+		run = udpRun{epoch: epoch}
+	}
+	maxSeq := run.maxSeq
+	switch {
+	case duplicate:
+		duplicates = 1
+	case seq < maxSeq:
+		reordered = 1
+	default:
+		expected = int(seq - maxSeq)
+		lost = expected - 1
+		run.maxSeq = seq
+	}
+	udpRuns[node] = run
+	for _, name := range []string{node, clusterName} {
+		w := getWindow(second, name)
+		w.udp = true
+		w.expected += expected
+		w.lost += lost
+		w.reordered += reordered
+		w.duplicates += duplicates
+	}
+}
+
+// handleDatagram splits a datagram into its lines, each taking its share of
+// the datagram's bytes
+func handleDatagram(pc net.PacketConn, addr net.Addr, dat string, timestampS float64) {
+	var lines []string
+	var shares []int
+	if strings.HasPrefix(dat, "Z ") {
+		i := strings.IndexByte(dat, '\n')
+		if i < 0 {
+			fmt.Fprintf(os.Stderr, "Logger: malformed frame from %s\n", addr)
+			return
+		}
+		count, _, err := parseFrameHeader(dat[:i+1])
+		if isError(err) {
+			return
+		}
+		lines, err = decodeFrame(count, []byte(dat[i+1:]))
+		if isError(err) {
+			return
+		}
+		shares = wireShares(len(dat), len(lines))
+	} else {
+		lines = strings.SplitAfter(dat, "\n")
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		for _, line := range lines {
+			shares = append(shares, len(line))
+		}
+	}
+	if nc, known := udpPeers[addr.String()]; known {
+		nc.conn.(*udpPeer).lastSeen = time.Now()
+	}
+	for i, line := range lines {
+		handleDatagramLine(pc, addr, line, timestampS, shares[i])
+	}
+}
+
+func handleDatagramLine(pc net.PacketConn, addr net.Addr, dat string, timestampS float64, wireBytes int) {
+	if strings.HasPrefix(dat, "PING ") {
+		pc.WriteTo([]byte("PONG "+dat[len("PING "):]), addr)
+		return
+	}
+	fields := strings.Fields(dat)
+	if len(fields) < 3 {
+		fmt.Fprintf(os.Stderr, "Logger: malformed datagram %q from %s\n", dat, addr)
+		return
+	}
+	nc, known := udpPeers[addr.String()]
+	if fields[0] == "SYNC" {
+		if known {
+			isError(handleSyncReply(nc, dat, timestampS))
+		}
+		return
+	}
+	fmt.Print(dat)
+
+	// "timestamp - nodeName connected" starts a new sender
+	if fields[1] == "-" && len(fields) >= 4 && fields[3] == "connected" {
+		nc = newUDPPeer(pc, addr, fields[2])
+		handleHello(nc, dat, timestampS)
+		return
+	}
+	// the hello datagram may be lost, take the name from the event
+	if !known || nc.name != fields[1] {
+		nc = newUDPPeer(pc, addr, fields[1])
+		go runSync(nc, syncInterval)
+	}
+	rec, isNew, err := handleEvent(nc, dat, timestampS, wireBytes)
+	if isError(err) || rec.Seq == 0 {
+		return
+	}
+	addUDPStats(nc.name, nodeEpoch(nc.name), rec.Seq, timestampS, !isNew)
+}
+
+// runUDP reads datagrams until the logger shuts down
+func runUDP(pc net.PacketConn) {
+	defer connsWg.Done()
+	defer evictIdle(time.Now(), -1)
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		timestampS := getTime()
+		if err != nil {
+			connsMtx.Lock()
+			stop := shuttingDown
+			connsMtx.Unlock()
+			if stop {
+				return
+			}
+			isError(err)
+			continue
+		}
+		handleDatagram(pc, addr, string(buf[:n]), timestampS)
+		if now := time.Now(); now.Sub(udpLastSweep) > udpIdleTimeout/2 {
+			evictIdle(now, udpIdleTimeout)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEvictIdle(t *testing.T) {
+	udpPeers = make(map[string]*nodeConn)
+	defer func() { udpPeers = make(map[string]*nodeConn) }()
+	now := time.Now()
+	idle := map[string]time.Duration{
+		"127.0.0.1:5001": 2 * time.Minute, // restarted node, old port
+		"127.0.0.1:5002": 10 * time.Second,
+		"127.0.0.1:5003": 0,
+	}
+	peers := make(map[string]*nodeConn)
+	for addr, d := range idle {
+		udpAddr, _ := net.ResolveUDPAddr("udp", addr)
+		nc := newUDPPeer(nil, udpAddr, "node1")
+		nc.conn.(*udpPeer).lastSeen = now.Add(-d)
+		peers[addr] = nc
+	}
+	evictIdle(now, time.Minute)
+	for addr, d := range idle {
+		_, kept := udpPeers[addr]
+		select {
+		case <-peers[addr].done:
+			if kept {
+				t.Errorf("%s: kept but done", addr)
+			}
+		default:
+			if !kept {
+				t.Errorf("%s: evicted but not done", addr)
+			}
+		}
+		if kept != (d <= time.Minute) {
+			t.Errorf("%s idle %v: kept=%v", addr, d, kept)
+		}
+	}
+	evictIdle(now, -1)
+	if len(udpPeers) != 0 {
+		t.Errorf("%d senders left after shutdown", len(udpPeers))
+	}
+}
+
+func TestUDPStatsRestart(t *testing.T) {
+	tests := []struct {
+		name          string
+		runs          []string // epoch of each datagram
+		seqs          []int64
+		wantLost      int
+		wantReordered int
+	}{
+		{"one run", []string{"1", "1", "1", "1"}, []int64{1, 3, 2, 4}, 1, 1},
+		{"restart", []string{"1", "1", "1", "2", "2"}, []int64{1, 2, 3, 1, 2}, 0, 0},
+		{"restart with loss", []string{"1", "1", "2", "2"}, []int64{1, 2, 2, 3}, 1, 0},
+	}
+	defer func() {
+		udpRuns = make(map[string]udpRun)
+		statsWindows = make(map[int64]map[string]*window)
+	}()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			udpRuns = make(map[string]udpRun)
+			statsWindows = make(map[int64]map[string]*window)
+			for i, seq := range tt.seqs {
+				addUDPStats("node1", tt.runs[i], seq, 100, false)
+			}
+			w := getWindow(100, "node1")
+			if w.lost != tt.wantLost || w.reordered != tt.wantReordered {
+				t.Errorf("lost %d reordered %d, want %d and %d", w.lost, w.reordered, tt.wantLost, tt.wantReordered)
+			}
+		})
+	}
+}
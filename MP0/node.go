@@ -1,21 +1,275 @@
 package main
 
-import "fmt"
-import "net"
-import "os"
-import "bufio"
-import "strings"
-import "time"
-
-func main(){
-	args := os.Args
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	To logger:
+		[timestamp] - [node name] connected epoch=[epoch] next=[seq]
+		[timestamp] [node name] [event] seq=[seq] lc=[lamport] (vc=[vector])
+		SYNC [id] [t1] [t2] [t3]
+		PING [t]
+	From logger:
+		SYNC [id] [t1]
+		ACK [seq] lc=[lamport] (vc=[vector])	// event seq is logged
+		PONG [t]
+	Events stay in pending until acked and are replayed after a reconnect.
+	With -udp every line is one datagram and events are sent once, never
+	replayed, so the logger can measure loss. With -batch or -compress
+	events are written in batches (see node_batch.go).
+	epoch is the start time of this process, so the logger can tell a
+	restarted node from a reconnecting one; seqs below next were generated.
+	With several loggers the node fails over between them (see
+	node_failover.go).
+*/
+
+const minBackoff = 100 * time.Millisecond
+const maxBackoff = 5 * time.Second
+
+// event : one generated event waiting for its ack
+type event struct {
+	seq    int64
+	msg    string
+	clock  string // logical clock stamps, see node_clock.go
+	queued time.Time
+}
+
+// session : one connection to the logger
+type session struct {
+	conn      net.Conn
+	closed    bool
+	lastHeard int64 // unix nano of the last line from the logger
+}
+
+var nodeName string
+var bufferSize int
+var udpMode bool
+
+var connMtx sync.Mutex // serializes writes to the logger
+
+// pending events, protected by queueMtx
+var queueMtx sync.Mutex
+var queueCond = sync.NewCond(&queueMtx)
+var pending []event
+var sent int // pending[:sent] were written on the current session
+var nextSeq int64 = 1
+var inputDone bool
+
+var epoch = time.Now().UnixNano()
+
+func getTimeString() string {
+	return fmt.Sprintf("%f", float64(time.Now().UnixNano())/float64(time.Second))
+}
+
+func writeLine(s *session, msg string) error {
+	connMtx.Lock()
+	defer connMtx.Unlock()
+	_, err := fmt.Fprint(s.conn, msg)
+	return err
+}
+
+func closeSession(s *session) {
+	queueMtx.Lock()
+	if !s.closed {
+		s.closed = true
+		s.conn.Close()
+	}
+	queueCond.Broadcast()
+	queueMtx.Unlock()
+}
+
+// enqueue adds a generated event, blocking while the buffer is full
+func enqueue(timestamp string, msg string) {
+	queueMtx.Lock()
+	for len(pending) >= bufferSize {
+		queueCond.Wait()
+	}
+	pending = append(pending, event{seq: nextSeq, msg: timestamp + " " + nodeName + " " + msg, clock: tick(), queued: time.Now()})
+	nextSeq++
+	queueCond.Broadcast()
+	queueMtx.Unlock()
+}
+
+// finishInput marks that no more events will be generated
+func finishInput() {
+	queueMtx.Lock()
+	inputDone = true
+	queueCond.Broadcast()
+	queueMtx.Unlock()
+}
+
+// readInput queues events from generator.py on stdin
+func readInput() {
 	scanner := bufio.NewScanner(os.Stdin)
-	conn , err := net.Dial("tcp", args[2] + ":" + args[3])
-	_ =  err
-	timeString := fmt.Sprintf("%f", float64(time.Now().UnixNano()) / float64(time.Second))
-	fmt.Fprintf(conn, timeString + " - " + args[1] +" connected\n")
 	for scanner.Scan() {
 		dat := strings.Split(scanner.Text(), " ")
-		fmt.Fprintf(conn, dat[0] + " " + args[1] + " " + dat[1] + "\n")
+		if len(dat) < 2 {
+			continue
+		}
+		enqueue(dat[0], dat[1])
+	}
+	finishInput()
+}
+
+func eventSeq(ev event) int64 { return ev.seq }
+
+// ack drops the pending event seq; pending is in seq order
+func ack(seq int64) {
+	queueMtx.Lock()
+	pending, sent = ackPending(pending, sent, eventSeq, false, seq)
+	queueCond.Broadcast()
+	queueMtx.Unlock()
+}
+
+func hello() string {
+	queueMtx.Lock()
+	next := nextSeq
+	queueMtx.Unlock()
+	return fmt.Sprintf("%s - %s connected epoch=%d next=%d\n", getTimeString(), nodeName, epoch, next)
+}
+
+// handleLogger answers clock offset probes and applies acks until the
+// connection breaks
+func handleLogger(s *session) {
+	reader := bufio.NewReader(s.conn)
+	for {
+		dat, err := reader.ReadString('\n')
+		if err != nil {
+			// over UDP an error (e.g. refused while the logger is down)
+			// only concerns one datagram
+			queueMtx.Lock()
+			closed := s.closed
+			queueMtx.Unlock()
+			if udpMode && !closed {
+				reader.Reset(s.conn)
+				continue
+			}
+			closeSession(s)
+			return
+		}
+		t2 := getTimeString()
+		heard(s)
+		fields := strings.Fields(dat)
+		if len(fields) == 3 && fields[0] == "SYNC" {
+			writeLine(s, fmt.Sprintf("SYNC %s %s %s %s\n", fields[1], fields[2], t2, getTimeString()))
+		} else if len(fields) >= 2 && fields[0] == "ACK" {
+			seq, e := strconv.ParseInt(fields[1], 10, 64)
+			if e == nil {
+				mergeClocks(parseOptions(fields[2:]))
+				ack(seq)
+			}
+		}
+	}
+}
+
+// sendPending writes pending events in batches, starting from the oldest
+// unacked one, until the session breaks or the input is done and everything
+// is acked; over UDP every event is sent once and dropped
+func sendPending(s *session) {
+	queueMtx.Lock()
+	sent = 0
+	for {
+		for !s.closed && !batchReady() && !(inputDone && len(pending) == 0) {
+			queueCond.Wait()
+		}
+		if s.closed || (inputDone && len(pending) == 0) {
+			queueMtx.Unlock()
+			return
+		}
+		batch := nextBatch()
+		queueMtx.Unlock()
+		if err := writeBatch(s, batch); err != nil && !udpMode {
+			closeSession(s)
+		}
+		queueMtx.Lock()
+	}
+}
+
+// dial tries the endpoints from the current one on and retries with
+// exponential backoff after each round until a logger accepts
+func dial() net.Conn {
+	backoff := minBackoff
+	for {
+		for range serverAddrs {
+			conn, err := dialLogger(serverAddrs[endpoint])
+			if err == nil {
+				return conn
+			}
+			fmt.Fprintf(os.Stderr, "Node: %v\n", err)
+			failover()
+		}
+		fmt.Fprintf(os.Stderr, "Node: cannot reach logger, retrying in %v\n", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func main() {
+	flag.IntVar(&bufferSize, "buffer", 1000, "max number of unacked events kept for replay")
+	flag.Float64Var(&genRate, "rate", 0, "generate events at this rate (Hz) instead of reading stdin")
+	flag.IntVar(&genMax, "max", 0, "stop after this many generated or replayed events, 0 for no limit")
+	flag.StringVar(&replayPath, "replay", "", "replay the events of a generator.py output file instead of reading stdin")
+	flag.BoolVar(&useVClock, "vclock", false, "attach a vector clock to every event")
+	flag.BoolVar(&udpMode, "udp", false, "send events as UDP datagrams, without acks or replay")
+	flag.IntVar(&batchSize, "batch", 1, "write up to this many events at once")
+	flag.DurationVar(&batchWait, "batch-wait", 50*time.Millisecond, "write a partial batch once its oldest event waited this long, 0 to wait for a full one")
+	flag.BoolVar(&compress, "compress", false, "send batches as compressed frames")
+	flag.DurationVar(&heartbeatInterval, "heartbeat", time.Second, "ping the logger this often, 0 to disable")
+	flag.DurationVar(&heartbeatTimeout, "heartbeat-timeout", 3*time.Second, "fail over when nothing was heard from the logger for this long")
+	flag.StringVar(&tlsCAPath, "tls-ca", "", "CA file the logger certificate is checked against, enables TLS")
+	flag.StringVar(&tlsCertPath, "tls-cert", "", "certificate file naming this node, for loggers that check nodes")
+	flag.StringVar(&tlsKeyPath, "tls-key", "", "private key file of -tls-cert")
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 || !parseEndpoints(args[1:]) || bufferSize < 1 || batchSize < 1 || genRate < 0 || (genRate > 0 && replayPath != "") {
+		fmt.Fprintf(os.Stderr, "Usage: ./node [-buffer n] [-rate hz | -replay file] [-max n] [-vclock] [-udp] [-batch n] [-batch-wait duration] [-compress]\n\t[-heartbeat d] [-heartbeat-timeout d]\n\t[-tls-ca file [-tls-cert file -tls-key file]] <NODE_NAME> <SERVER_IP> <PORT_NUMBER>\n\t(or <NODE_NAME> <HOST:PORT,HOST:PORT,...>)\n")
+		os.Exit(1)
+	}
+	if err := setupTLS(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if udpMode && tlsConfig != nil {
+		fmt.Fprintf(os.Stderr, "Node: UDP has no TLS, -udp and -tls-ca exclude each other\n")
+		os.Exit(1)
+	}
+	nodeName = args[0]
+	if genRate > 0 {
+		go generate()
+	} else if replayPath != "" {
+		go replay()
+	} else {
+		go readInput()
+	}
+
+	for {
+		s := &session{conn: dial(), lastHeard: time.Now().UnixNano()}
+		go handleLogger(s)
+		go heartbeat(s)
+		if writeLine(s, hello()) == nil {
+			sendPending(s)
+		}
+		closeSession(s)
+
+		queueMtx.Lock()
+		done := inputDone && len(pending) == 0
+		queueMtx.Unlock()
+		if done {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Node: lost connection to logger, reconnecting\n")
+		failover()
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"time"
+)
+
+/*
+	Batching (-batch [n] -batch-wait [duration] -compress)
+		Unsent events are written together once n are waiting, the oldest
+		has waited batch-wait, the buffer is full or the input is done.
+		A batch is its event lines in one write, or with -compress
+			Z [count] [length]\n[length bytes of DEFLATE data]
+		holding the same lines. Over UDP a batch is one datagram, so keep
+		it under 64 KB. Each event keeps its own timestamp and seq, so the
+		logger still measures the delay of every event.
+*/
+
+var batchSize int
+var batchWait time.Duration
+var compress bool
+
+var flushTimer *time.Timer // wakes sendPending when the oldest event is due
+
+// armFlush wakes sendPending after d, protected by queueMtx
+func armFlush(d time.Duration) {
+	if flushTimer == nil {
+		flushTimer = time.AfterFunc(d, func() {
+			queueMtx.Lock()
+			queueCond.Broadcast()
+			queueMtx.Unlock()
+		})
+		return
+	}
+	flushTimer.Reset(d)
+}
+
+// batchReady reports whether the unsent events should be written now,
+// protected by queueMtx
+func batchReady() bool {
+	unsent := len(pending) - sent
+	if unsent <= 0 {
+		return false
+	}
+	if unsent >= batchSize || inputDone || len(pending) >= bufferSize {
+		return true
+	}
+	if batchWait <= 0 {
+		return false
+	}
+	waited := time.Since(pending[sent].queued)
+	if waited >= batchWait {
+		return true
+	}
+	armFlush(batchWait - waited)
+	return false
+}
+
+// nextBatch takes up to batchSize unsent events, protected by queueMtx;
+// over UDP they are dropped from pending
+func nextBatch() []event {
+	n := len(pending) - sent
+	if n > batchSize {
+		n = batchSize
+	}
+	batch := append([]event{}, pending[sent:sent+n]...)
+	if udpMode {
+		pending = pending[n:]
+		queueCond.Broadcast()
+	} else {
+		sent += n
+	}
+	return batch
+}
+
+func formatEvent(ev event) string {
+	return fmt.Sprintf("%s seq=%d %s\n", ev.msg, ev.seq, ev.clock)
+}
+
+// writeBatch writes a batch in one write, compressed with -compress
+func writeBatch(s *session, batch []event) error {
+	var lines bytes.Buffer
+	for _, ev := range batch {
+		lines.WriteString(formatEvent(ev))
+	}
+	if !compress {
+		return writeLine(s, lines.String())
+	}
+	var data bytes.Buffer
+	w, _ := flate.NewWriter(&data, flate.DefaultCompression)
+	w.Write(lines.Bytes())
+	w.Close()
+	return writeLine(s, fmt.Sprintf("Z %d %d\n", len(batch), data.Len())+data.String())
+}
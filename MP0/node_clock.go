@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	Logical clocks, attached to every event
+		[timestamp] [node name] [event] seq=[seq] lc=[lamport] vc=[name:count,...]
+	vc is only sent with -vclock. Acks carry the logger's merged clocks
+		ACK [seq] lc=[lamport] vc=[name:count,...]
+	and are merged like any received message, so an event that follows an
+	ack is ordered after every event the logger had logged before it.
+*/
+
+var useVClock bool
+
+var clockMtx sync.Mutex
+var lamport int64
+var vclock = make(map[string]int64)
+
+// tick advances the clocks for a local event and returns its stamps
+func tick() string {
+	clockMtx.Lock()
+	defer clockMtx.Unlock()
+	lamport++
+	stamp := fmt.Sprintf("lc=%d", lamport)
+	if useVClock {
+		vclock[nodeName]++
+		stamp += " vc=" + formatVClock(vclock)
+	}
+	return stamp
+}
+
+// mergeClocks applies the clocks carried by a message from the logger
+func mergeClocks(opts map[string]string) {
+	clockMtx.Lock()
+	defer clockMtx.Unlock()
+	if lc, err := strconv.ParseInt(opts["lc"], 10, 64); err == nil {
+		if lc > lamport {
+			lamport = lc
+		}
+		lamport++
+	}
+	if !useVClock || opts["vc"] == "" {
+		return
+	}
+	for _, entry := range strings.Split(opts["vc"], ",") {
+		i := strings.LastIndexByte(entry, ':')
+		if i <= 0 {
+			continue
+		}
+		count, err := strconv.ParseInt(entry[i+1:], 10, 64)
+		if err == nil && count > vclock[entry[:i]] {
+			vclock[entry[:i]] = count
+		}
+	}
+}
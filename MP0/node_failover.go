@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Logger endpoints and failover
+		./node [node name] [host:port,host:port,...]
+	The first endpoint is the primary. The node stays on an endpoint until
+	a write fails or nothing was heard from it for -heartbeat-timeout, then
+	moves on to the next one (wrapping around) and replays what is unacked
+	there. Heartbeats keep a quiet connection checked:
+		node -> logger: PING [t]	// every -heartbeat
+		logger -> node: PONG [t]
+	Any line from the logger (PONG, SYNC, ACK) counts as heard.
+*/
+
+var serverAddrs []string
+var endpoint int // index of the current endpoint in serverAddrs
+
+var heartbeatInterval time.Duration
+var heartbeatTimeout time.Duration
+
+// parseEndpoints reads either "ip port" or a list "host:port,host:port"
+func parseEndpoints(args []string) bool {
+	switch len(args) {
+	case 2:
+		serverAddrs = append(serverAddrs, args[0]+":"+args[1])
+	case 1:
+		for _, addr := range strings.Split(args[0], ",") {
+			if !strings.Contains(addr, ":") {
+				return false
+			}
+			serverAddrs = append(serverAddrs, addr)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// failover moves on to the next endpoint
+func failover() {
+	if len(serverAddrs) < 2 {
+		return
+	}
+	endpoint = (endpoint + 1) % len(serverAddrs)
+	fmt.Fprintf(os.Stderr, "Node: failing over to %s\n", serverAddrs[endpoint])
+}
+
+func heard(s *session) {
+	atomic.StoreInt64(&s.lastHeard, time.Now().UnixNano())
+}
+
+// heartbeat pings the logger every heartbeatInterval and closes the session
+// once nothing was heard for heartbeatTimeout
+func heartbeat(s *session) {
+	if heartbeatInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		queueMtx.Lock()
+		closed := s.closed
+		queueMtx.Unlock()
+		if closed {
+			return
+		}
+		silent := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastHeard)))
+		if heartbeatTimeout > 0 && silent > heartbeatTimeout {
+			fmt.Fprintf(os.Stderr, "Node: nothing heard from %s for %v\n", s.conn.RemoteAddr(), silent.Round(time.Millisecond))
+			closeSession(s)
+			return
+		}
+		writeLine(s, fmt.Sprintf("PING %s\n", getTimeString()))
+	}
+}
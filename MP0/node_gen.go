@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Built-in event sources, used instead of "generator.py | ./node"
+		-rate [hz]		same events as generator.py: "[timestamp] [sha256 hex]"
+						with Poisson arrivals at hz events per second
+		-replay [file]	the events of a saved generator.py output, with their
+						original spacing but stamped with the current time
+		-max [n]		stop after n events
+*/
+
+var genRate float64
+var genMax int
+var replayPath string
+
+// randomHash returns the sha256 of 20 random bytes, like generator.py
+func randomHash() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func generate() {
+	for count := 0; genMax == 0 || count < genMax; count++ {
+		enqueue(getTimeString(), randomHash())
+		time.Sleep(time.Duration(mrand.ExpFloat64() / genRate * float64(time.Second)))
+	}
+	finishInput()
+}
+
+func replay() {
+	f, err := os.Open(replayPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Node: cannot open %s: %v\n", replayPath, err)
+		finishInput()
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var last float64
+	count := 0
+	for scanner.Scan() && (genMax == 0 || count < genMax) {
+		dat := strings.Split(scanner.Text(), " ")
+		if len(dat) < 2 {
+			continue
+		}
+		ts, err := strconv.ParseFloat(dat[0], 64)
+		if err != nil {
+			continue
+		}
+		if count > 0 && ts > last {
+			time.Sleep(time.Duration((ts - last) * float64(time.Second)))
+		}
+		last = ts
+		enqueue(getTimeString(), dat[1])
+		count++
+	}
+	finishInput()
+}
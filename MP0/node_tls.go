@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+/*
+	TLS to the logger (-tls-ca, -tls-cert, -tls-key)
+		-tls-ca verifies the logger's certificate and turns TLS on. A logger
+		started with its own -tls-ca also wants -tls-cert and -tls-key, a
+		certificate whose common name is the node name.
+	UDP has no TLS, -udp is refused together with these flags.
+*/
+
+var tlsCAPath, tlsCertPath, tlsKeyPath string
+var tlsConfig *tls.Config
+
+// setupTLS loads the certificates given on the command line
+func setupTLS() error {
+	if tlsCAPath == "" && tlsCertPath == "" && tlsKeyPath == "" {
+		return nil
+	}
+	if tlsCAPath == "" {
+		return fmt.Errorf("Node: -tls-ca is needed to check the logger")
+	}
+	pem, err := os.ReadFile(tlsCAPath)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("Node: no certificate in %s", tlsCAPath)
+	}
+	tlsConfig = &tls.Config{RootCAs: pool}
+	if tlsCertPath != "" || tlsKeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCertPath, tlsKeyPath)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return nil
+}
+
+// dialLogger connects to addr over the configured transport
+func dialLogger(addr string) (net.Conn, error) {
+	if udpMode {
+		return net.Dial("udp", addr)
+	}
+	if tlsConfig != nil {
+		return tls.Dial("tcp", addr, tlsConfig)
+	}
+	return net.Dial("tcp", addr)
+}
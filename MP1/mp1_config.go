@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+	Cluster membership, one of
+		-config [file]			one node per line, # starts a comment
+			[id] [host:port]
+		-nodes [host:port,...]	node i is the i-th address
+	Node IDs are 0 .. n-1, each listed once; the cluster has n nodes.
+	A node finds its own ID by matching its interface addresses against
+	the hosts and listens on the port next to its entry.
+*/
+
+var configPath string
+var nodeList string
+
+var members []string     // host:port by node ID
+var memberIPs [][]string // addresses of each member's host
+
+// loadConfig reads a membership file
+func loadConfig(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	byID := make(map[int]string)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Node: %s:%d: want [id] [host:port]", path, lineNum)
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("Node: %s:%d: bad node id %q", path, lineNum, fields[0])
+		}
+		if _, ok := byID[id]; ok {
+			return nil, fmt.Errorf("Node: %s:%d: node %d listed twice", path, lineNum, id)
+		}
+		byID[id] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	list := make([]string, len(byID))
+	for id, addr := range byID {
+		if id >= len(list) {
+			return nil, fmt.Errorf("Node: %s: node ids must be 0 to %d", path, len(list)-1)
+		}
+		list[id] = addr
+	}
+	return list, nil
+}
+
+// setupMembers loads the membership given on the command line and
+// resolves every host
+func setupMembers() error {
+	var err error
+	switch {
+	case configPath != "" && nodeList != "":
+		return fmt.Errorf("Node: -config and -nodes do not go together")
+	case configPath != "":
+		members, err = loadConfig(configPath)
+	case nodeList != "":
+		members = strings.Split(nodeList, ",")
+	}
+	if err != nil {
+		return err
+	}
+	if len(members) == 0 {
+		return fmt.Errorf("Node: no cluster members, use -config or -nodes")
+	}
+	memberIPs = make([][]string, len(members))
+	for id, addr := range members {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("Node: node %d: %v", id, err)
+		}
+		memberIPs[id], err = net.LookupHost(host)
+		if err != nil {
+			return fmt.Errorf("Node: node %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// memberByIP returns the first node whose host has address ip, -1 if none
+func memberByIP(ip string) int {
+	for id, ips := range memberIPs {
+		for _, addr := range ips {
+			if net.ParseIP(addr).Equal(net.ParseIP(ip)) {
+				return id
+			}
+		}
+	}
+	return -1
+}
+
+// memberPort returns the port of node id
+func memberPort(id int) string {
+	_, port, _ := net.SplitHostPort(members[id])
+	return port
+}
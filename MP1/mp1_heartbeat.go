@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+	Failure detector (-heartbeat [interval] -heartbeat-timeout [timeout])
+		Every node sends B [pid] to each peer every interval. A peer that
+		has sent nothing at all for longer than timeout is taken as failed,
+		as if its connection broke: writes to it stop and messages waiting
+		only for it go ahead. Anything it sends afterwards makes it a false
+		positive; its connection is closed, so it stays failed here.
+		If the detector itself wakes up more than an interval late (the
+		node was stopped or starved), the silence may be its own: it
+		starts timing every peer afresh instead of suspecting anyone.
+	interval must be positive and below timeout; with timeout 0 the
+	detector is off and no heartbeats are sent.
+	Both are logged in failure.txt
+		[time] Suspect [pid] [seconds since last heard]
+		[time] FalsePositive [pid] [seconds since suspected]
+	and counted on stderr at exit.
+*/
+
+var path3 = "failure.txt"
+var file3, err_f3 = os.OpenFile(path3, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+
+var heartbeatInterval time.Duration
+var heartbeatTimeout time.Duration
+
+var mBeat sync.Mutex
+var lastHeard = make(map[int]time.Time)   // key: pid of a connected peer
+var suspectedAt = make(map[int]time.Time) // key: pid taken as failed
+var numSuspected int
+var numFalsePositives int
+
+// watchPeer starts heartbeats to a newly connected peer
+func watchPeer(id int) {
+	if heartbeatTimeout <= 0 {
+		return
+	}
+	mBeat.Lock()
+	lastHeard[id] = time.Now()
+	mBeat.Unlock()
+	go sendHeartbeats(id)
+}
+
+func sendHeartbeats(id int) {
+	beat := fmt.Sprintf("B %d\n", nodeID)
+	for !interrupted && isAlive[id] {
+		if _, err := conn[id].Write([]byte(beat)); err != nil {
+			return
+		}
+		file1.WriteString(getTimeString() + " " + fmt.Sprintf("%d", len(beat)) + "\n")
+		time.Sleep(heartbeatInterval)
+	}
+}
+
+// heard records that id sent something; it reports false for a peer
+// already taken as failed
+func heard(id int) bool {
+	now := time.Now()
+	mBeat.Lock()
+	defer mBeat.Unlock()
+	if at, ok := suspectedAt[id]; ok {
+		numFalsePositives++
+		fmt.Fprintf(os.Stderr, "Node: false positive, node %d was heard %.3fs after it was suspected\n", id, now.Sub(at).Seconds())
+		file3.WriteString(getTimeString() + " FalsePositive " + fmt.Sprintf("%d %f", id, now.Sub(at).Seconds()) + "\n")
+		return false
+	}
+	lastHeard[id] = now
+	return true
+}
+
+// detectFailures takes the peers silent for longer than the timeout as failed
+func detectFailures() {
+	if heartbeatTimeout <= 0 {
+		return
+	}
+	woke := time.Now()
+	for !interrupted {
+		time.Sleep(heartbeatInterval)
+		now := time.Now()
+		slept := now.Sub(woke)
+		woke = now
+		var failed []int
+		mBeat.Lock()
+		if slept > 2*heartbeatInterval {
+			fmt.Fprintf(os.Stderr, "Node: failure detector slept %.3fs, restarting the timeouts\n", slept.Seconds())
+			for id := range lastHeard {
+				lastHeard[id] = now
+			}
+		}
+		for id, last := range lastHeard {
+			if _, ok := suspectedAt[id]; ok || !isAlive[id] || now.Sub(last) <= heartbeatTimeout {
+				continue
+			}
+			suspectedAt[id] = now
+			numSuspected++
+			failed = append(failed, id)
+			fmt.Fprintf(os.Stderr, "Node: suspect node %d, not heard for %.3fs\n", id, now.Sub(last).Seconds())
+			file3.WriteString(getTimeString() + " Suspect " + fmt.Sprintf("%d %f", id, now.Sub(last).Seconds()) + "\n")
+		}
+		mBeat.Unlock()
+		for _, id := range failed {
+			// unblock writes stuck on a hung peer, reads go on
+			conn[id].SetWriteDeadline(now)
+			nodeFailed(id)
+		}
+	}
+}
+
+func printDetectorSummary() {
+	mBeat.Lock()
+	defer mBeat.Unlock()
+	fmt.Fprintf(os.Stderr, "Node: failure detector suspected %d nodes, %d false positives\n", numSuspected, numFalsePositives)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"container/heap"
+	"flag"
 	"fmt"
 	"net"
 	"os"
@@ -18,13 +19,14 @@ import (
 	M [pid] [ord] [pri] msg
 	P [pid] [ord] [pri]					//Propose
 	F [pid]	[ord] [pri]					//Final
+	H [pid]							//Hello, first line of a connection
+	B [pid]							//Heartbeat
 */
 
 /** Debug */
 var countPyMsg int = 0
 var countDeliveredMsg int = 0
 
-const argNumNode int = 2
 var path1 = "bandwidth.txt"
 var path2 = "log.txt"
 var file1, err_f1 = os.OpenFile(path1, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
@@ -32,22 +34,16 @@ var file2, err_f2 = os.OpenFile(path2, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 
 var interrupted bool = false
 
-var nodeID int
+var nodeID int = -1
 
-const maxNodes int = 10
 const releasedState int = 0
 
-var ipAddr = [10]string{
-	"172.22.156.112", "172.22.158.112", "172.22.94.112", "172.22.156.113",
-	"172.22.158.113", "172.22.94.113", "172.22.156.114", "172.22.158.114",
-	"172.22.94.114", "172.22.156.115"}
-
 var m sync.Mutex
 var mBal sync.Mutex
 
 
-var conn [maxNodes]net.Conn
-var isAlive [maxNodes]bool
+var conn []net.Conn
+var isAlive []bool
 var numAlive int
 
 var numNodes int
@@ -65,7 +61,8 @@ type Item struct {
 	priority int
 	index int // The index of the item in the heap.
 	deliverable bool
-	agreedNodes [maxNodes]bool
+	agreedNodes []bool
+	vc []int // causal order only
 }
 
 type PriorityQueue []*Item
@@ -94,15 +91,23 @@ func getTimeString() string{
 	return fmt.Sprintf("%f", float64(time.Now().UnixNano())/float64(time.Second))
 }
 
-func getIdByConn(c net.Conn) int {
-	addr := c.RemoteAddr()
-	ip := addr.String()
-	for i:=0; i < maxNodes; i++{
-		if strings.Contains(ip, ipAddr[i]) {
-			return i
-		}
+const helloTimeout = 5 * time.Second
+
+// readHello reads the node ID a peer announces on a new connection, -1 if
+// it sends none in time; the reader keeps whatever follows the hello
+func readHello(c net.Conn) (int, *bufio.Reader) {
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(helloTimeout))
+	line, err := reader.ReadString('\n')
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		return -1, reader
 	}
-	return -1
+	var id int
+	if n, _ := fmt.Sscanf(line, "H %d\n", &id); n != 1 || id < 0 || id >= numNodes {
+		return -1, reader
+	}
+	return id, reader
 }
 
 var msgItems map[string]int
@@ -111,7 +116,8 @@ func (pq PriorityQueue) Len() int { return len(pq) }
 
 func (pq PriorityQueue) Less(i, j int) bool {
 	return (pq[i].priority < pq[j].priority) || 
-			((pq[i].priority == pq[j].priority) && (pq[i].pid < pq[j].pid))
+			((pq[i].priority == pq[j].priority) && (pq[i].pid < pq[j].pid)) ||
+			((pq[i].priority == pq[j].priority) && (pq[i].pid == pq[j].pid) && (pq[i].ord < pq[j].ord))
 }
 
 func (pq PriorityQueue) Swap(i, j int) {
@@ -156,6 +162,10 @@ func peekDeliverable() int{
 		return 1
 	}
 	if (!isAlive[item.pid]){
+		// a final priority forwarded by another node may still be coming
+		if time.Since(diedAt[item.pid]) < orphanDelay {
+			return 0
+		}
 		return -1
 	}
 	flag := true
@@ -199,11 +209,9 @@ func getNodeID() {
 			case *net.IPAddr:
 				ip = j.IP
 			}
-			for index := 0; index < maxNodes; index++ {
-				if ipAddr[index] == ip.String() {
-					nodeID = index
-					return
-				}
+			if index := memberByIP(ip.String()); index >= 0 {
+				nodeID = index
+				return
 			}
 		}
 	}
@@ -267,15 +275,21 @@ func setNodeUnavailable(id int){
 	if (isAlive[id]){
 		numAlive--
 		isAlive[id] = false
+		diedAt[id] = time.Now()
 	}
 }
 
 func broadcast(message string) {
+	broadcastExcept(message, nodeID, nodeID)
+}
+
+// broadcastExcept sends message to every alive node but a and b
+func broadcastExcept(message string, a int, b int) {
 	// fmt.Print("Connections:")
 	for i := 0; i < numNodes; i++ {
 		// fmt.Print(" ", conn[i])
-		if i != nodeID && isAlive[i] {
-			_, e := fmt.Fprintf(conn[i], message+"\n")
+		if i != nodeID && i != a && i != b && isAlive[i] {
+			_, e := fmt.Fprint(conn[i], message+"\n")
 			
 			if (e!=nil) {
 				setNodeUnavailable(i)
@@ -290,9 +304,54 @@ func broadcast(message string) {
 	//fmt.Println()
 }
 
+// deliverReady pops the deliverable messages at the head of the queue,
+// delivering them or dropping those of dead senders
+func deliverReady() {
+	peekVal := 1
+	for peekVal != 0{
+		peekVal = peekDeliverable()
+		if peekVal == 0{
+			break
+		}
+		head := heap.Pop(&pq).(*Item)
+		// Last message processed
+		timeLast = getTimeString()
+		//fmt.Println(timeLast, "LastMessage", head.pid ,head.ord , head.msg)
+		file2.WriteString(timeLast + " LastMessage " + fmt.Sprintf("%d %d ", head.pid ,head.ord ) + head.msg + "\n")
+		if (peekVal == 1) {
+			deliverMsg(head.msg)
+		}
+	}
+}
+
+// nodeFailed marks id dead and finishes what was only waiting for it
+func nodeFailed(id int) {
+	m.Lock()
+	setNodeUnavailable(id)
+	// own messages that now have every alive proposal
+	for _, item := range pq {
+		if item.pid != nodeID || item.deliverable {
+			continue
+		}
+		flag := true
+		for i := 0; i < numNodes; i++ {
+			if !item.agreedNodes[i] && isAlive[i] && i != nodeID {
+				flag = false
+				break
+			}
+		}
+		if flag {
+			item.deliverable = true
+			seenF[fmt.Sprintf("%d:%d", item.pid, item.ord)] = true
+			broadcast(fmt.Sprintf("F %d %d %d", item.pid, item.ord, item.priority))
+		}
+	}
+	deliverReady()
+	m.Unlock()
+}
+
 // Handles connection
-func handleConn(id int) {
-	reader := bufio.NewReader(conn[id])
+func handleConn(id int, reader *bufio.Reader) {
 	for !interrupted{
 		msg, err := reader.ReadString('\n')
 		// bandwidth
@@ -302,10 +361,14 @@ func handleConn(id int) {
 		file1.WriteString(timeBandwidth + " " +  fmt.Sprintf("%d", len(msg)) + "\n")
 		m.Unlock()
 		if err != nil {
-			setNodeUnavailable(id)
+			nodeFailed(id)
 			break
 		}
-		if (msg == "" || msg == "\n"){
+		if !heard(id) {
+			conn[id].Close()
+			break
+		}
+		if (msg == "" || msg == "\n" || msg[0] == 'B'){
 			continue
 		}
 		if last := len(msg) - 1; last >= 0 && msg[last] == '\n' {
@@ -317,34 +380,57 @@ func handleConn(id int) {
 		if (msg[0] == 'M'){
 			msgPid, _ := strconv.Atoi(dat[1])
 			msgOrd, _ := strconv.Atoi(dat[2])
+			m.Lock()
+			if !firstSeen(seenM, dat[1]+":"+dat[2]) {
+				m.Unlock()
+				continue
+			}
+			// forward before acting, everyone gets it even if the sender crashes now
+			broadcastExcept(msg, id, msgPid)
+			if orderMode != orderTotal {
+				receiveOrdered(msgPid, msgOrd, dat[3], dat[4])
+				m.Unlock()
+				continue
+			}
 			item := &Item{
 				msg: dat[4],
 				pid: msgPid,
 				ord: msgOrd,
 				priority: nextPriority,
 				deliverable: false,
+				agreedNodes: make([]bool, numNodes),
 			}
 			// fmt.Println("Received message: ", item)
-			m.Lock()
-			fmt.Fprintf(conn[id], fmt.Sprintf("P %s %s %d\n",dat[1],dat[2],nextPriority))
+			if isAlive[msgPid] && conn[msgPid] != nil {
+				fmt.Fprintf(conn[msgPid], "P %s %s %d\n", dat[1], dat[2], nextPriority)
 
-			// bandwidth
-			timeBandwidth = getTimeString()
-			// fmt.Println(timeBandwidth, "Bandwidth: ", len(fmt.Sprintf("P %s %s %d\n",dat[1],dat[2],nextPriority)))
-			file1.WriteString(timeBandwidth + " " +  fmt.Sprintf("%d", len(fmt.Sprintf("P %s %s %d\n",dat[1],dat[2],nextPriority))) + "\n")
+				// bandwidth
+				timeBandwidth = getTimeString()
+				// fmt.Println(timeBandwidth, "Bandwidth: ", len(fmt.Sprintf("P %s %s %d\n",dat[1],dat[2],nextPriority)))
+				file1.WriteString(timeBandwidth + " " +  fmt.Sprintf("%d", len(fmt.Sprintf("P %s %s %d\n",dat[1],dat[2],nextPriority))) + "\n")
+			}
 
 			nextPriority += 1
 			heap.Push(&pq, item)
+			if applyPendingFinal(item) {
+				deliverReady()
+			}
 			m.Unlock()
 		} else if (msg[0] == 'P'){
 			m.Lock()
 			proposed, _ := strconv.Atoi(dat[3])
-			item := pq[msgItems[dat[1]+":"+dat[2]]]
+			index, ok := msgItems[dat[1]+":"+dat[2]]
+			if !ok || index < 0 {
+				// already delivered or dropped
+				m.Unlock()
+				continue
+			}
+			item := pq[index]
 			// fmt.Println("Map result: ", item.msg)
 			item.agreedNodes[id] = true
 			item.priority = max(proposed, item.priority)
 			pq.update(item)
-			nextPriority = item.priority + 1
+			nextPriority = max(nextPriority, item.priority + 1)
 			flag := true
 			for i:=0; i<numNodes; i++{
 				if (!item.agreedNodes[i] && isAlive[i] && i != nodeID){
@@ -354,48 +440,22 @@ func handleConn(id int) {
 			}
 			if (flag){
 				item.deliverable = true
+				seenF[dat[1]+":"+dat[2]] = true
 				broadcast(fmt.Sprintf("F %s %s %d", dat[1], dat[2], item.priority))
-				peekVal := 1
-				for peekVal != 0{
-					peekVal = peekDeliverable()
-					if peekVal == 0{
-						break
-					}
-					head := heap.Pop(&pq).(*Item)
-					// Last message processed
-					timeLast = getTimeString()
-					// 
-					//fmt.Println(timeLast, "LastMessage",  head.pid ,head.ord , head.msg)
-					file2.WriteString(timeLast + " LastMessage " + fmt.Sprintf("%d %d ", head.pid ,head.ord ) + head.msg + "\n")
-					// fmt.Println("Trace pop item from msg:", msg)
-					if (peekVal == 1) {
-						deliverMsg(head.msg)
-					}
-				}
+				deliverReady()
 			}	
 			m.Unlock()
 		} else if (msg[0] == 'F'){
+			msgPid, _ := strconv.Atoi(dat[1])
+			final, _ := strconv.Atoi(dat[3])
 			m.Lock()
-			// fmt.Println("id:",msgItems[dat[1]+":"+dat[2]], " pq:",len(pq))
-			item := pq[msgItems[dat[1]+":"+dat[2]]]
-			// fmt.Println("Map result: ", item.msg)
-			item.deliverable = true
-			peekVal := 1
-			for peekVal != 0{
-				peekVal = peekDeliverable()
-				if peekVal == 0{
-					break
-				}
-				head := heap.Pop(&pq).(*Item)
-				// fmt.Println("Trace pop item from msg:", msg)
-				// Last message processed
-				timeLast = getTimeString()
-				//fmt.Println(timeLast, "LastMessage", head.pid ,head.ord , head.msg)
-				file2.WriteString(timeLast + " LastMessage " + fmt.Sprintf("%d %d ", head.pid ,head.ord ) + head.msg + "\n")
-				if (peekVal == 1) {
-					deliverMsg(head.msg)
-				}
+			if !firstSeen(seenF, dat[1]+":"+dat[2]) {
+				m.Unlock()
+				continue
 			}
+			broadcastExcept(msg, id, msgPid)
+			setFinal(dat[1]+":"+dat[2], final)
+			deliverReady()
 			m.Unlock()
 		} 
 	}
@@ -423,18 +483,19 @@ func handleLocal() {
 			msg:    messageLocal,
 			pid: nodeID,
 			ord: getNextOrd(),
-			priority: nextPriority,
 			deliverable: false,
 		}
 		m.Lock()
+		item.priority = nextPriority
+		seenM[fmt.Sprintf("%d:%d", item.pid, item.ord)] = true
 		// First message processed
 		//fmt.Println(timeFirst, "FirstMessage", item.pid ,item.ord , messageLocal)
 		file2.WriteString(timeFirst + " FirstMessage " + fmt.Sprintf("%d %d ", item.pid ,item.ord) + messageLocal + "\n")
 		// fmt.Println(getTimeString(), "pid: " , item.pid ,  " ord: ", item.ord , " Python: ", messageLocal)
-		for i := 0; i < maxNodes; i++{
-			item.agreedNodes[i] = false
-		}
-		if numAlive > 1{
+		item.agreedNodes = make([]bool, numNodes)
+		if orderMode != orderTotal {
+			sendOrdered(item)
+		} else if numAlive > 1{
 			broadcast(fmt.Sprintf("M %d %d %d %s", item.pid, item.ord, item.priority, item.msg))
 			nextPriority += 1
 			heap.Push(&pq, item)
@@ -462,8 +523,6 @@ func printBalance(){
 
 
 func main() {
-	// Get node id
-	getNodeID()
 	// Sigint
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT)
@@ -481,44 +540,92 @@ func main() {
 		return
 	}
 	defer file2.Close()
+	if isError(err_f3) {
+		return
+	}
+	defer file3.Close()
 	// Arguments
-	argv := os.Args[1:]
-	if len(argv) != argNumNode {
-		fmt.Fprintf(os.Stderr, "Usage: ./mp1_node <NODE NUMBER> <PORT_NUMBER>\n")
+	flag.StringVar(&configPath, "config", "", "cluster membership file, one [id] [host:port] per line")
+	flag.StringVar(&nodeList, "nodes", "", "cluster membership as host:port,... in node id order")
+	flag.IntVar(&nodeID, "id", -1, "node id of this process (default: the member with a local address)")
+	flag.DurationVar(&heartbeatInterval, "heartbeat", time.Second, "interval between heartbeats to every peer")
+	flag.DurationVar(&heartbeatTimeout, "heartbeat-timeout", 5*time.Second, "silence after which a peer is taken as failed, 0 turns the detector off")
+	flag.StringVar(&orderMode, "order", orderTotal, "delivery order of all nodes: fifo, causal or total (ISIS)")
+	flag.Parse()
+	if flag.NArg() != 0 || (configPath == "" && nodeList == "") {
+		fmt.Fprintf(os.Stderr, "Usage: ./mp1_node -config <CLUSTER_FILE> | -nodes <HOST:PORT,...>\n")
+		os.Exit(1)
+	}
+	handleErr(setupMembers())
+	numNodes = len(members)
+	if orderMode != orderFIFO && orderMode != orderCausal && orderMode != orderTotal {
+		fmt.Fprintf(os.Stderr, "Node: unknown order %q, want fifo, causal or total\n", orderMode)
+		os.Exit(1)
+	}
+	if heartbeatInterval <= 0 || heartbeatTimeout < 0 || (heartbeatTimeout > 0 && heartbeatTimeout <= heartbeatInterval) {
+		fmt.Fprintf(os.Stderr, "Node: -heartbeat must be positive and below -heartbeat-timeout (0 for no detector)\n")
 		os.Exit(1)
 	}
-	numNodes, _ = strconv.Atoi(argv[0])
-	port = argv[1]
+	// Get node id
+	if nodeID < 0 {
+		getNodeID()
+	}
+	if nodeID < 0 {
+		fmt.Fprintf(os.Stderr, "Node: no cluster member has a local address, use -id\n")
+		os.Exit(1)
+	}
+	if nodeID >= numNodes {
+		fmt.Fprintf(os.Stderr, "Node: node %d is not in the cluster of %d\n", nodeID, numNodes)
+		os.Exit(1)
+	}
+	port = memberPort(nodeID)
 	// Initialize data
 	pq = make(PriorityQueue, 0)
 	heap.Init(&pq)
 	balance = make(map[string]int)
 	msgItems = make(map[string](int))
+	conn = make([]net.Conn, numNodes)
+	isAlive = make([]bool, numNodes)
+	diedAt = make([]time.Time, numNodes)
+	delivered = make([]int, numNodes)
 	for i := 0; i < numNodes; i++{
 		isAlive[i] = true
 	}
 	numAlive = numNodes
+	go detectFailures()
+	go releaseOrphans()
 	// TCP server
 	ln, e := net.Listen("tcp", ":"+port)
 	handleErr(e)
 	for i := nodeID + 1; i < numNodes; i++ {
 		c, e := ln.Accept()
 		handleErr(e)
-		index:=getIdByConn(c)
+		index, reader := readHello(c)
+		if index <= nodeID || conn[index] != nil {
+			fmt.Fprintf(os.Stderr, "Node: unexpected connection from %s\n", c.RemoteAddr())
+			c.Close()
+			i--
+			continue
+		}
 		conn[index] = c
-		go handleConn(index)
+		watchPeer(index)
+		go handleConn(index, reader)
 	}
 	// TCP client
 	for i := 0; i < nodeID; i++ {
 		for {
-			conn[i], e = net.Dial("tcp", ipAddr[i]+":"+port)
+			conn[i], e = net.Dial("tcp", members[i])
 			if e == nil {break}
+			time.Sleep(100 * time.Millisecond)
 		}
-		go handleConn(i)
+		fmt.Fprintf(conn[i], "H %d\n", nodeID)
+		watchPeer(i)
+		go handleConn(i, bufio.NewReader(conn[i]))
 	}
 	go printBalance()
 	handleLocal()
 	defer ln.Close()
+	printDetectorSummary()
 	// fmt.Fprintf(os.Stderr,"Last BALANCES")
 	// 	for k, v := range balance{
 	// 		fmt.Fprintf(os.Stderr, " %d:%d", k, v)
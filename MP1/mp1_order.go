@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+	Delivery order (-order fifo|causal|total), the same on every node
+		total	ISIS, M is answered with P and finished with F
+		fifo	M [pid] [ord] 0 msg
+				ord is the sender's sequence number, messages of each sender
+				are delivered in ord order
+		causal	M [pid] [ord] [vc] msg
+				vc is the sender's vector clock, messages delivered from each
+				node separated by commas, with its own entry counting this
+				message; a message waits until everything it depends on is
+				delivered
+	fifo and causal have no P and F: the sender delivers its own message
+	right away and every node delivers from a holdback queue. M is still
+	forwarded by reliable multicast.
+*/
+
+const (
+	orderFIFO   = "fifo"
+	orderCausal = "causal"
+	orderTotal  = "total"
+)
+
+var orderMode string
+
+var delivered []int  // messages delivered per sender, fifo and causal
+var holdback []*Item // received, not yet deliverable
+
+// sendOrdered multicasts a local message and delivers it here
+func sendOrdered(item *Item) {
+	stamp := "0"
+	if orderMode == orderCausal {
+		counts := make([]string, numNodes)
+		for i, n := range delivered {
+			counts[i] = strconv.Itoa(n)
+		}
+		counts[nodeID] = strconv.Itoa(item.ord + 1)
+		stamp = strings.Join(counts, ",")
+	}
+	broadcast(fmt.Sprintf("M %d %d %s %s", item.pid, item.ord, stamp, item.msg))
+	deliverOrdered(item)
+}
+
+// receiveOrdered holds back a multicast message until it can be delivered
+func receiveOrdered(pid int, ord int, stamp string, msg string) {
+	item := &Item{msg: msg, pid: pid, ord: ord}
+	if orderMode == orderCausal {
+		counts := strings.Split(stamp, ",")
+		if len(counts) != numNodes {
+			fmt.Fprintf(os.Stderr, "Node: bad vector clock %q from node %d\n", stamp, pid)
+			return
+		}
+		item.vc = make([]int, numNodes)
+		for i, c := range counts {
+			item.vc[i], _ = strconv.Atoi(c)
+		}
+	}
+	holdback = append(holdback, item)
+	for progress := true; progress; {
+		progress = false
+		for i := 0; i < len(holdback); i++ {
+			if canDeliver(holdback[i]) {
+				deliverOrdered(holdback[i])
+				holdback = append(holdback[:i], holdback[i+1:]...)
+				progress = true
+				i--
+			}
+		}
+	}
+}
+
+func canDeliver(item *Item) bool {
+	if orderMode == orderFIFO {
+		return item.ord == delivered[item.pid]
+	}
+	for i, c := range item.vc {
+		if i == item.pid && c != delivered[i]+1 {
+			return false
+		}
+		if i != item.pid && c > delivered[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func deliverOrdered(item *Item) {
+	delivered[item.pid]++
+	// Last message processed
+	timeLast = getTimeString()
+	file2.WriteString(timeLast + " LastMessage " + fmt.Sprintf("%d %d ", item.pid, item.ord) + item.msg + "\n")
+	deliverMsg(item.msg)
+}
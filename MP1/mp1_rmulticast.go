@@ -0,0 +1,76 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+)
+
+/*
+	Reliable multicast under the ISIS ordering
+		A node that gets an M or F message for the first time forwards it
+		to every other alive node (but the sender and the node it came
+		from) before acting on it; copies it has seen are ignored, keyed by
+		[pid]:[ord]. So if any alive node has a message, all of them get it,
+		even when the sender crashes halfway through its broadcast.
+		Proposals go straight back to the sender, wherever M came from.
+	A message whose sender is dead and which has no final priority yet is
+	dropped only orphanDelay after the failure, so that an F forwarded by
+	a node that did get it has time to arrive.
+*/
+
+const orphanDelay = 2 * time.Second
+
+var seenM = make(map[string]bool)       // key: pid:ord
+var seenF = make(map[string]bool)       // key: pid:ord
+var pendingFinal = make(map[string]int) // F that came before its M, key: pid:ord
+var diedAt []time.Time
+
+// firstSeen marks key as seen in seen and reports whether it was new
+func firstSeen(seen map[string]bool, key string) bool {
+	if seen[key] {
+		return false
+	}
+	seen[key] = true
+	return true
+}
+
+// setFinal gives the message key its final priority and makes it deliverable
+func setFinal(key string, final int) {
+	nextPriority = max(nextPriority, final+1)
+	index, ok := msgItems[key]
+	if !ok {
+		pendingFinal[key] = final
+		return
+	}
+	if index < 0 {
+		// already dropped
+		return
+	}
+	item := pq[index]
+	item.priority = final
+	item.deliverable = true
+	heap.Fix(&pq, index)
+}
+
+// applyPendingFinal applies an F that arrived before item, reporting
+// whether there was one
+func applyPendingFinal(item *Item) bool {
+	key := fmt.Sprintf("%d:%d", item.pid, item.ord)
+	final, ok := pendingFinal[key]
+	if ok {
+		delete(pendingFinal, key)
+		setFinal(key, final)
+	}
+	return ok
+}
+
+// releaseOrphans drops the messages of dead senders once orphanDelay is over
+func releaseOrphans() {
+	for !interrupted {
+		time.Sleep(orphanDelay / 2)
+		m.Lock()
+		deliverReady()
+		m.Unlock()
+	}
+}